@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/master_src"
+)
+
+// defaultConfig is a small uneven pool under a bursty workload.
+var defaultConfig = master.SimConfig{
+	Seed: 1,
+	Slaves: []master.SimSlave{
+		{Name: "big", Count: 2, MaxLoad: 400, Speed: 200},
+		{Name: "medium", Count: 4, MaxLoad: 200, Speed: 100},
+		{Name: "small", Count: 4, MaxLoad: 100, Speed: 50, FailureRate: 0.01},
+	},
+	Workload: master.SimWorkload{
+		Tasks:      5000,
+		RatePerSec: 40,
+		MinLoad:    5,
+		MaxLoad:    60,
+		Types:      []string{"fibonacci", "count_primes"},
+		Keys:       100,
+	},
+}
+
+func main() {
+	configPath := flag.String("config", "", "JSON file with the simulation config (master.SimConfig), a built in pool is used if not given")
+	algos := flag.String("algorithms", strings.Join(master.Algorithms(), ","), "comma separated algorithms to compare")
+	seed := flag.Int64("seed", 0, "seed of the simulation, overrides the config if not 0")
+	tasks := flag.Int("tasks", 0, "number of tasks to generate, overrides the config if not 0")
+	rate := flag.Float64("rate", 0, "tasks per second to generate, overrides the config if not 0")
+	noInFlight := flag.Bool("no-inflight", false, "balance on reported loads only, without the tasks in flight")
+	asJSON := flag.Bool("json", false, "print the reports as JSON")
+	flag.Parse()
+
+	cfg := defaultConfig
+	if *configPath != "" {
+		data, err := ioutil.ReadFile(*configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		cfg = master.SimConfig{}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid config: "+err.Error())
+			os.Exit(1)
+		}
+	}
+	if *seed != 0 {
+		cfg.Seed = *seed
+	}
+	if *tasks != 0 {
+		cfg.Workload.Tasks = *tasks
+	}
+	if *rate != 0 {
+		cfg.Workload.RatePerSec = *rate
+	}
+	if *noInFlight {
+		cfg.NoInFlight = true
+	}
+	// Every algorithm gets the same trace.
+	if len(cfg.Trace) == 0 {
+		trace, err := master.GenerateTrace(cfg.Workload, cfg.Seed)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid workload: "+err.Error())
+			os.Exit(1)
+		}
+		cfg.Trace = trace
+	}
+
+	var reports []master.SimReport
+	for _, algo := range strings.Split(*algos, ",") {
+		lb, err := master.NewLoadBalancer(algo)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error()+": "+algo)
+			os.Exit(1)
+		}
+		r, err := master.Simulate(cfg, lb)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		r.Algorithm = algo
+		reports = append(reports, r)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(reports)
+		return
+	}
+
+	ms := func(d time.Duration) string {
+		return fmt.Sprintf("%.0f", float64(d)/float64(time.Millisecond))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "algorithm\tdone\tfailed\trejected\tgave up\tunplaced\ttasks/s\tp50 ms\tp95 ms\tp99 ms\tqueue ms\timbalance\tpeak imb\t")
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t%.3f\t%.3f\t\n",
+			r.Algorithm, r.Completed, r.Failed, r.Rejections, r.GaveUp, r.Unplaced, r.Throughput,
+			ms(r.LatencyP50), ms(r.LatencyP95), ms(r.LatencyP99), ms(r.MeanQueueWait),
+			r.Imbalance, r.PeakImbalance)
+	}
+	w.Flush()
+}
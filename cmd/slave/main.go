@@ -1,14 +1,67 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
 	"github.com/GoodDeeds/load-balancer/common/logger"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
 	"github.com/GoodDeeds/load-balancer/slave_src"
 )
 
+// Labels are given as arguments after the flags, e.g.
+// ./slave -id node-1 -capacity count_primes=2 zone=a hardware=gpu
 func main() {
+	id := flag.String("id", "", "stable ID of the slave across reconnections, a random ID is used if empty")
+	capacity := flag.String("capacity", "", "comma separated max number of tasks of a type to run at once, e.g. count_primes=2,fibonacci=4")
+	drainTimeout := flag.Duration("drain-timeout", 0, "how long a draining slave waits for its tasks, the default is used if 0")
+	flag.Parse()
+
+	labels := make(map[string]string)
+	for _, arg := range flag.Args() {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			fmt.Fprintln(os.Stderr, "Invalid label, expected key=value: "+arg)
+			os.Exit(1)
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	taskCapacity := make(map[string]int)
+	if *capacity != "" {
+		for _, c := range strings.Split(*capacity, ",") {
+			kv := strings.SplitN(c, "=", 2)
+			if len(kv) != 2 {
+				fmt.Fprintln(os.Stderr, "Invalid capacity, expected type=n: "+c)
+				os.Exit(1)
+			}
+			if _, err := tasks.LookupByName(kv[0]); err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid capacity: "+err.Error())
+				os.Exit(1)
+			}
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 0 {
+				fmt.Fprintln(os.Stderr, "Invalid capacity, expected a non negative number: "+c)
+				os.Exit(1)
+			}
+			taskCapacity[kv[0]] = n
+		}
+	}
+	if *drainTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "Invalid drain timeout: "+drainTimeout.String())
+		os.Exit(1)
+	}
+
 	logger.SetLogLevel(logger.DEBUG)
 	s := slave.Slave{
-		Logger: logger.NewLogger("master"),
+		Logger:       logger.NewLogger("master"),
+		ID:           *id,
+		Labels:       labels,
+		TaskCapacity: taskCapacity,
+		DrainTimeout: *drainTimeout,
 	}
 	s.Run()
 }
@@ -30,6 +30,11 @@ const (
 	GarbageCollectionInterval                    = 5 * time.Second
 	TaskInterval                                 = 5 * time.Second
 	ReceiveTimeout                               = 10 * time.Second
+	TaskStatusPollInterval                       = 2 * time.Second
+	FinishedTaskRetention                        = 10 * time.Minute
+
+	// DefaultTaskDeadline is used by the /fibonacii and /cprimt endpoints.
+	DefaultTaskDeadline = 2 * time.Second
 
 	// SlaveReceiveTimeout should be bigger than LoadRequestInterval.
 	SlaveReceiveTimeout          = 10 * time.Second
@@ -43,4 +48,60 @@ const (
 	MaxSlaves           = 30
 
 	ConnectRetryBackoffBaseTime time.Duration = 2 * time.Second
+	// A slave which lost the master tries to connect again, waiting twice
+	// as long after every failed attempt up to ReconnectBackoffMaxTime.
+	ReconnectBackoffMaxTime time.Duration = 1 * time.Minute
+
+	// MaxTaskRetries is the default number of times a task rejected
+	// by a slave is sent to another slave.
+	MaxTaskRetries           = 3
+	TaskRetryBackoffBaseTime = 500 * time.Millisecond
+
+	// MaxPendingTasks is the default size of the queue of tasks waiting for a slave.
+	MaxPendingTasks = 1000
+	// QueueFullRetryAfter is sent in Retry-After when the queue is full.
+	QueueFullRetryAfter = LoadRequestInterval
+
+	// A batch keeps at most MaxBatchInFlight of its items submitted at
+	// once, and submits the rest as those finish. Unfinished items are
+	// cancelled after MaxBatchDuration, or the timeout of the batch if shorter.
+	MaxBatchInFlight = 100
+	MaxBatchDuration = 30 * time.Minute
+
+	// MaxConnectPacketSize is the max size of a packet of the UDP handshake.
+	MaxConnectPacketSize = 2048
+	// MaxFrameSize is the max size of a single packet on any TCP connection.
+	MaxFrameSize uint32 = 1 << 20
+
+	// LatencyEWMAWeight is the weight of a new sample in the latency EWMA.
+	LatencyEWMAWeight float64 = 0.2
+	// LatencyPeakDecayTime is the time in which the peak EWMA of latency
+	// decays by a factor of e towards the newer samples.
+	LatencyPeakDecayTime = 10 * time.Second
+
+	// A slave's circuit breaker opens after BreakerConsecutiveFailures
+	// failed probes or tasks in a row, or when BreakerErrorRate of the last
+	// BreakerWindowSize outcomes failed (with at least BreakerMinSamples).
+	// It stays open for BreakerOpenTime, then lets a trial through.
+	BreakerConsecutiveFailures         = 3
+	BreakerWindowSize                  = 20
+	BreakerMinSamples                  = 10
+	BreakerErrorRate           float64 = 0.5
+	BreakerOpenTime                    = 30 * time.Second
+
+	// Slaves send a heartbeat every HeartbeatInterval. The master computes
+	// the phi of the accrual failure detector from the intervals of the last
+	// HeartbeatWindowSize heartbeats, the slave is suspect when phi reaches
+	// HeartbeatSuspectPhi and dead (evicted) when it reaches HeartbeatDeadPhi.
+	HeartbeatInterval              = 1 * time.Second
+	HeartbeatCheckInterval         = 1 * time.Second
+	HeartbeatWindowSize            = 100
+	HeartbeatMinStdDev             = 500 * time.Millisecond
+	HeartbeatSuspectPhi    float64 = 8
+	HeartbeatDeadPhi       float64 = 16
+
+	// A draining slave gets no new tasks and is disconnected once its tasks
+	// finish, or after DrainTimeout. Progress is checked every DrainCheckInterval.
+	DrainTimeout       = 5 * time.Minute
+	DrainCheckInterval = 1 * time.Second
 )
@@ -0,0 +1,157 @@
+package packets
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+/*
+	Every packet sent over a TCP stream is wrapped in a frame:
+
+		| length (4 bytes, big endian) | packet type (1 byte) | gob payload |
+
+	The length covers the packet type byte and the payload, so the bytes
+	following the header are exactly what EncodePacket produces and what
+	GetPacketType/DecodePacket expect.
+*/
+
+const (
+	FrameHeaderSize int = 4
+
+	// DefaultMaxFrameSize is used when a FrameReader or FrameWriter is
+	// created with a max frame size of 0.
+	DefaultMaxFrameSize uint32 = 1 << 20
+)
+
+var (
+	ErrFrameTooLarge  = errors.New("Frame exceeds max frame size")
+	ErrEmptyFrame     = errors.New("Frame has no packet type")
+	ErrTruncatedFrame = errors.New("Stream ended in the middle of a frame")
+)
+
+// FrameWriter writes length prefixed packets to a stream.
+// It is safe for concurrent use.
+type FrameWriter struct {
+	w            io.Writer
+	maxFrameSize uint32
+	mtx          sync.Mutex
+}
+
+func NewFrameWriter(w io.Writer, maxFrameSize uint32) *FrameWriter {
+	if maxFrameSize == 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &FrameWriter{
+		w:            w,
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// WritePacket encodes the packet and writes it as a single frame.
+func (fw *FrameWriter) WritePacket(packet interface{}, packetType PacketType) error {
+	buf, err := EncodePacket(packet, packetType)
+	if err != nil {
+		return err
+	}
+	return fw.WriteFrame(buf)
+}
+
+// WriteFrame writes an already encoded packet (type byte + payload) as a single frame.
+func (fw *FrameWriter) WriteFrame(buf []byte) error {
+	if len(buf) == 0 {
+		return ErrEmptyFrame
+	}
+	if uint64(len(buf)) > uint64(fw.maxFrameSize) {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, FrameHeaderSize+len(buf))
+	binary.BigEndian.PutUint32(frame[:FrameHeaderSize], uint32(len(buf)))
+	copy(frame[FrameHeaderSize:], buf)
+
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+	_, err := fw.w.Write(frame)
+	return err
+}
+
+// FrameReader reads length prefixed packets from a stream.
+// A read that fails with a temporary error (e.g. a read deadline) keeps the
+// partially read frame, so ReadFrame can simply be called again.
+type FrameReader struct {
+	r            io.Reader
+	maxFrameSize uint32
+
+	header  [FrameHeaderSize]byte
+	headerN int
+	body    []byte
+	bodyN   int
+}
+
+func NewFrameReader(r io.Reader, maxFrameSize uint32) *FrameReader {
+	if maxFrameSize == 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &FrameReader{
+		r:            r,
+		maxFrameSize: maxFrameSize,
+	}
+}
+
+// ReadFrame returns the next packet (type byte + payload) from the stream.
+// io.EOF is returned only when the stream ends on a frame boundary,
+// otherwise ErrTruncatedFrame is returned.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	for fr.headerN < FrameHeaderSize {
+		n, err := fr.r.Read(fr.header[fr.headerN:])
+		fr.headerN += n
+		if err != nil {
+			if fr.headerN < FrameHeaderSize {
+				return nil, fr.readError(err, fr.headerN == 0)
+			}
+			break
+		}
+	}
+
+	if fr.body == nil {
+		size := binary.BigEndian.Uint32(fr.header[:])
+		if size == 0 {
+			fr.reset()
+			return nil, ErrEmptyFrame
+		}
+		if size > fr.maxFrameSize {
+			// The stream cannot be resynchronised after this.
+			fr.reset()
+			return nil, ErrFrameTooLarge
+		}
+		fr.body = make([]byte, size)
+		fr.bodyN = 0
+	}
+
+	for fr.bodyN < len(fr.body) {
+		n, err := fr.r.Read(fr.body[fr.bodyN:])
+		fr.bodyN += n
+		if err != nil && fr.bodyN < len(fr.body) {
+			return nil, fr.readError(err, false)
+		}
+	}
+
+	buf := fr.body
+	fr.reset()
+	return buf, nil
+}
+
+func (fr *FrameReader) readError(err error, atBoundary bool) error {
+	if err == io.EOF && !atBoundary {
+		return ErrTruncatedFrame
+	}
+	return err
+}
+
+func (fr *FrameReader) reset() {
+	fr.headerN = 0
+	fr.body = nil
+	fr.bodyN = 0
+}
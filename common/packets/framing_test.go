@@ -0,0 +1,139 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// frames returns the packets written as frames to one buffer.
+func frames(t *testing.T, packets ...HeartbeatPacket) *bytes.Buffer {
+	var buf bytes.Buffer
+	fw := NewFrameWriter(&buf, 0)
+	for _, p := range packets {
+		if err := fw.WritePacket(p, Heartbeat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &buf
+}
+
+func readHeartbeat(t *testing.T, fr *FrameReader) HeartbeatPacket {
+	buf, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatalf("ReadFrame = %v", err)
+	}
+	if packetType, err := GetPacketType(buf); err != nil || packetType != Heartbeat {
+		t.Fatalf("packet type = %v, %v, want Heartbeat", packetType, err)
+	}
+	var p HeartbeatPacket
+	if err := DecodePacket(buf, &p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestFrameReaderSplitAndCoalescedFrames(t *testing.T) {
+	readers := map[string]func(io.Reader) io.Reader{
+		// Both frames arrive in one read.
+		"coalesced": func(r io.Reader) io.Reader { return r },
+		// Every read returns a single byte, splitting headers and bodies.
+		"split": iotest.OneByteReader,
+		"half":  iotest.HalfReader,
+	}
+	for name, wrap := range readers {
+		fr := NewFrameReader(wrap(frames(t, HeartbeatPacket{Seq: 1}, HeartbeatPacket{Seq: 2})), 0)
+		for seq := uint64(1); seq <= 2; seq++ {
+			if p := readHeartbeat(t, fr); p.Seq != seq {
+				t.Errorf("%s: seq = %d, want %d", name, p.Seq, seq)
+			}
+		}
+		if _, err := fr.ReadFrame(); err != io.EOF {
+			t.Errorf("%s: ReadFrame at the end = %v, want io.EOF", name, err)
+		}
+	}
+}
+
+func TestFrameReaderTruncatedFrame(t *testing.T) {
+	full := frames(t, HeartbeatPacket{Seq: 1}).Bytes()
+	for _, n := range []int{1, FrameHeaderSize, FrameHeaderSize + 1, len(full) - 1} {
+		fr := NewFrameReader(bytes.NewReader(full[:n]), 0)
+		if _, err := fr.ReadFrame(); err != ErrTruncatedFrame {
+			t.Errorf("ReadFrame of %d of %d bytes = %v, want %v", n, len(full), err, ErrTruncatedFrame)
+		}
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewFrameWriter(&buf, 4).WriteFrame(make([]byte, 5)); err != ErrFrameTooLarge {
+		t.Fatalf("WriteFrame above the max = %v, want %v", err, ErrFrameTooLarge)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes written for a frame which is too large", buf.Len())
+	}
+
+	fr := NewFrameReader(frames(t, HeartbeatPacket{Seq: 1}), 4)
+	if _, err := fr.ReadFrame(); err != ErrFrameTooLarge {
+		t.Fatalf("ReadFrame above the max = %v, want %v", err, ErrFrameTooLarge)
+	}
+}
+
+func TestEmptyFrame(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewFrameWriter(&buf, 0).WriteFrame(nil); err != ErrEmptyFrame {
+		t.Fatalf("WriteFrame of nothing = %v, want %v", err, ErrEmptyFrame)
+	}
+
+	// An empty frame is skipped, the next one is still read.
+	binary.Write(&buf, binary.BigEndian, uint32(0))
+	frames(t, HeartbeatPacket{Seq: 1}).WriteTo(&buf)
+	fr := NewFrameReader(&buf, 0)
+	if _, err := fr.ReadFrame(); err != ErrEmptyFrame {
+		t.Fatalf("ReadFrame of an empty frame = %v, want %v", err, ErrEmptyFrame)
+	}
+	if p := readHeartbeat(t, fr); p.Seq != 1 {
+		t.Fatalf("seq after an empty frame = %d, want 1", p.Seq)
+	}
+}
+
+func TestFrameReaderResumesAfterDeadline(t *testing.T) {
+	full := frames(t, HeartbeatPacket{Seq: 7}).Bytes()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// The header and part of the body, then the rest after the deadline.
+	cut := FrameHeaderSize + 2
+	written := make(chan error, 1)
+	go func() {
+		_, err := remote.Write(full[:cut])
+		written <- err
+	}()
+
+	fr := NewFrameReader(local, 0)
+	local.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := fr.ReadFrame()
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("ReadFrame in the middle of a frame = %v, want a timeout", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_, err := remote.Write(full[cut:])
+		written <- err
+	}()
+	local.SetReadDeadline(time.Now().Add(time.Second))
+	if p := readHeartbeat(t, fr); p.Seq != 7 {
+		t.Fatalf("seq after resuming = %d, want 7", p.Seq)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -35,32 +35,54 @@ const (
 	TaskResultResponse
 	TaskStatusRequest
 	TaskStatusResponse
+	TaskCancel
+	Heartbeat
+	Drain
+	Resume
 	PacketTypeEnd
 )
 
-// Task Type IDs
-const (
-	FibonacciTaskType TaskType = iota
-	CountPrimesTaskType
-)
-
-var LoadFunctions map[TaskType]func(int) uint64 = map[TaskType]func(int) uint64{
-	FibonacciTaskType: func(n int) uint64 {
-		return uint64(n)
-	},
-	CountPrimesTaskType: func(n int) uint64 {
-		return uint64(n) * uint64(n)
-	},
-}
-
 // Status codes
 const (
 	Complete Status = iota
 	Incomplete
 	Invalid
 	Unassigned
+	Assigned
+	Accepted
+	Running
+	Failed
+	Cancelled
+	TimedOut
 )
 
+func (s Status) String() string {
+	switch s {
+	case Complete:
+		return "Complete"
+	case Incomplete:
+		return "Incomplete"
+	case Invalid:
+		return "Invalid"
+	case Unassigned:
+		return "Unassigned"
+	case Assigned:
+		return "Assigned"
+	case Accepted:
+		return "Accepted"
+	case Running:
+		return "Running"
+	case Failed:
+		return "Failed"
+	case Cancelled:
+		return "Cancelled"
+	case TimedOut:
+		return "TimedOut"
+	default:
+		return ""
+	}
+}
+
 type PacketTransmit struct {
 	Packet     interface{}
 	PacketType PacketType
@@ -98,6 +120,14 @@ func (pt PacketType) String() string {
 		return "AskSlaveForTaskStatus"
 	case TaskStatusResponse:
 		return "SlaveReplyTaskStatus"
+	case TaskCancel:
+		return "CancelTaskOnSlave"
+	case Heartbeat:
+		return "SlaveHeartbeat"
+	case Drain:
+		return "SlaveDrain"
+	case Resume:
+		return "SlaveResume"
 	default:
 		return ""
 	}
@@ -117,6 +147,22 @@ type BroadcastConnectResponse struct {
 	LoadReqPort uint16
 	ReqSendPort uint16
 	ReqRecvPort uint16
+	// Task types for which the slave has an executor.
+	Capabilities []Capability
+	// Labels of the slave, e.g. zone, hardware class or owner.
+	Labels map[string]string
+	// SlaveID stays the same when the slave connects again.
+	SlaveID string
+}
+
+// Capability is a task type a slave can run.
+type Capability struct {
+	TaskType TaskType
+	// Version of the task type on the slave.
+	Version int
+	// MaxConcurrent is the max number of tasks of the type the slave
+	// runs at once. No limit if 0.
+	MaxConcurrent int
 }
 
 type LoadRequestPacket struct {
@@ -161,6 +207,10 @@ func EncodePacket(packet interface{}, packetType PacketType) ([]byte, error) {
 	case TaskResultResponsePacket:
 	case TaskStatusRequestPacket:
 	case TaskStatusResponsePacket:
+	case TaskCancelPacket:
+	case HeartbeatPacket:
+	case DrainPacket:
+	case ResumePacket:
 	default:
 		_ = t
 		return nil, errors.New("Invalid packet")
@@ -194,6 +244,8 @@ type TaskRequestPacket struct {
 	TaskId int
 	Task   TaskPacket
 	Load   uint64
+	// Deadline is the time by which the task must finish. Zero means no deadline.
+	Deadline time.Time
 }
 
 type TaskRequestResponsePacket struct {
@@ -216,6 +268,29 @@ type TaskStatusResponsePacket struct {
 	TaskStatus Status // from status constants in constants.go
 }
 
+type TaskCancelPacket struct {
+	TaskId int
+}
+
+// HeartbeatPacket is sent by the slave every HeartbeatInterval.
+type HeartbeatPacket struct {
+	Seq       uint64
+	Timestamp time.Time
+}
+
+// DrainPacket is sent by a slave going out of rotation. The master stops
+// assigning tasks to it and waits up to Timeout for its tasks. The master
+// sends it to a drained slave, which then shuts down.
+type DrainPacket struct {
+	Timeout time.Duration
+}
+
+// ResumePacket is the first packet a slave sends on a new connection, with
+// the tasks it still holds. It goes over TCP as the list can be long.
+type ResumePacket struct {
+	Tasks []int
+}
+
 type TaskResult struct {
 	Result string
 }
@@ -223,18 +298,16 @@ type TaskResult struct {
 type TaskPacket struct {
 	TaskTypeID TaskType
 	N          int
+	Args       map[string]string
 	Result     uint64
 	IntResult  int
+	Output     map[string]string
 	Close      chan struct{}
 }
 
-func (t *TaskPacket) Description() string {
-	switch t.TaskTypeID {
-	case FibonacciTaskType:
-		return "Task to find Nth fibonacci number"
-	case CountPrimesTaskType:
-		return "Task to find the number of primes <= N"
-	default:
-		return "Unknown task type"
+func (t *TaskPacket) SetOutput(name, value string) {
+	if t.Output == nil {
+		t.Output = make(map[string]string)
 	}
+	t.Output[name] = value
 }
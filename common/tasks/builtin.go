@@ -0,0 +1,116 @@
+package tasks
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+// maxN is the largest n of the built in task types, so that their load
+// fits in a uint64.
+const maxN = math.MaxInt32
+
+// Task Type IDs of the built in task types.
+const (
+	FibonacciTaskType packets.TaskType = iota
+	CountPrimesTaskType
+)
+
+func init() {
+	MustRegister(Definition{
+		ID:          FibonacciTaskType,
+		Name:        "fibonacci",
+		Description: "Task to find Nth fibonacci number",
+		Args: []Field{
+			{Name: "n", Kind: IntField, Required: true, Description: "Index of the fibonacci number", Min: 0, Max: maxN},
+		},
+		Results: []Field{
+			{Name: "result", Kind: UintField, Description: "Nth fibonacci number"},
+		},
+		Load: func(t *packets.TaskPacket) uint64 {
+			return uint64(t.N)
+		},
+		Execute: func(ctx context.Context, t *packets.TaskPacket) error {
+			res, err := findFibonacci(ctx, t.N)
+			if err != nil {
+				return err
+			}
+			t.Result = res
+			t.SetOutput("result", strconv.FormatUint(t.Result, 10))
+			return nil
+		},
+	})
+
+	MustRegister(Definition{
+		ID:          CountPrimesTaskType,
+		Name:        "count_primes",
+		Description: "Task to find the number of primes <= N",
+		Args: []Field{
+			{Name: "n", Kind: IntField, Required: true, Description: "Upper limit", Min: 0, Max: maxN},
+		},
+		Results: []Field{
+			{Name: "result", Kind: UintField, Description: "Number of primes <= N"},
+		},
+		Load: func(t *packets.TaskPacket) uint64 {
+			return uint64(t.N) * uint64(t.N)
+		},
+		Execute: func(ctx context.Context, t *packets.TaskPacket) error {
+			count, err := countPrimes(ctx, t.N)
+			if err != nil {
+				return err
+			}
+			t.IntResult = count
+			t.Result = uint64(t.IntResult)
+			t.SetOutput("result", strconv.Itoa(t.IntResult))
+			return nil
+		},
+	})
+}
+
+// cancelCheckInterval is the number of iterations after which
+// findFibonacci checks if it was cancelled.
+const cancelCheckInterval = 1 << 10
+
+func findFibonacci(ctx context.Context, N int) (uint64, error) {
+	var a0 uint64
+	var a1 uint64
+	a0 = 0
+	a1 = 1
+	for i := 0; i < N/2; i++ {
+		if i%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		a0 = a0 + a1
+		a1 = a0 + a1
+	}
+	if N%2 == 0 {
+		return a0, nil
+	} else {
+		return a1, nil
+	}
+}
+
+func countPrimes(ctx context.Context, N int) (int, error) {
+	if N <= 1 {
+		return 0, nil
+	}
+	count := 0
+	for i := 2; i <= N; i++ {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		isPrime := true
+		for j := 2; j < i; j++ {
+			if i%j == 0 {
+				isPrime = false
+				break
+			}
+		}
+		if isPrime {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,23 @@
+package tasks
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestNewTaskRejectsOutOfRangeN(t *testing.T) {
+	for _, name := range []string{"fibonacci", "count_primes"} {
+		for _, n := range []string{"-1", strconv.Itoa(maxN + 1), "9223372036854775807"} {
+			if _, err := NewTask(name, map[string]string{"n": n}); err == nil {
+				t.Errorf("%s with n = %s: NewTask succeeded, want an error", name, n)
+			}
+		}
+		task, err := NewTask(name, map[string]string{"n": strconv.Itoa(maxN)})
+		if err != nil {
+			t.Fatalf("%s with the largest n: %v", name, err)
+		}
+		if load, _ := EstimateLoad(task); load < uint64(maxN) {
+			t.Errorf("%s load with the largest n = %d, want at least %d", name, load, maxN)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+/*
+	The registry holds every task type known to this process. Master and slave
+	must register the same task types with the same IDs, since only the ID is
+	sent over the network. The slave advertises the task types for which it has
+	an executor with their versions, and the master only sends a task to slaves
+	which advertised the same version of its type.
+*/
+
+type FieldKind string
+
+const (
+	IntField    FieldKind = "int"
+	UintField   FieldKind = "uint"
+	StringField FieldKind = "string"
+)
+
+// Field describes one argument or result of a task type.
+type Field struct {
+	Name        string
+	Kind        FieldKind
+	Required    bool
+	Description string
+	// Min and Max bound the value of an int or uint argument. No bounds
+	// if both are 0.
+	Min int64
+	Max int64
+}
+
+// Definition describes a task type.
+type Definition struct {
+	ID          packets.TaskType
+	Name        string
+	Description string
+	// Version of the args and results of the task type. The master sends
+	// a task only to slaves with the same version of the task type.
+	// 1 is used if 0.
+	Version int
+
+	Args    []Field
+	Results []Field
+
+	// Load estimates the load the task puts on a slave.
+	Load func(t *packets.TaskPacket) uint64
+	// Execute runs the task on a slave and fills the results in t.
+	// It should return ctx.Err() soon after ctx is done.
+	// It is needed only on the slave.
+	Execute func(ctx context.Context, t *packets.TaskPacket) error
+}
+
+var (
+	ErrUnknownTaskType = errors.New("Unknown task type")
+	ErrNoExecutor      = errors.New("No executor for task type")
+)
+
+var (
+	registryMtx sync.RWMutex
+	byID        = make(map[packets.TaskType]*Definition)
+	byName      = make(map[string]*Definition)
+)
+
+// Register adds a task type to the registry.
+func Register(def Definition) error {
+	if def.Name == "" {
+		return errors.New("Task type needs a name")
+	}
+	if def.Load == nil {
+		return errors.New("Task type needs a load estimator")
+	}
+
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	if _, ok := byID[def.ID]; ok {
+		return errors.New("Task type ID already registered: " + strconv.Itoa(int(def.ID)))
+	}
+	if _, ok := byName[def.Name]; ok {
+		return errors.New("Task type name already registered: " + def.Name)
+	}
+	d := def
+	if d.Version == 0 {
+		d.Version = 1
+	}
+	byID[def.ID] = &d
+	byName[def.Name] = &d
+	return nil
+}
+
+// MustRegister is like Register but panics on error.
+func MustRegister(def Definition) {
+	if err := Register(def); err != nil {
+		panic(err)
+	}
+}
+
+func Lookup(id packets.TaskType) (*Definition, error) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	def, ok := byID[id]
+	if !ok {
+		return nil, ErrUnknownTaskType
+	}
+	return def, nil
+}
+
+func LookupByName(name string) (*Definition, error) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	def, ok := byName[name]
+	if !ok {
+		return nil, ErrUnknownTaskType
+	}
+	return def, nil
+}
+
+// All returns all registered task types sorted by ID.
+func All() []*Definition {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	defs := make([]*Definition, 0, len(byID))
+	for _, def := range byID {
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].ID < defs[j].ID })
+	return defs
+}
+
+// Executable returns the IDs of task types which this process can run.
+func Executable() []packets.TaskType {
+	var ids []packets.TaskType
+	for _, def := range All() {
+		if def.Execute != nil {
+			ids = append(ids, def.ID)
+		}
+	}
+	return ids
+}
+
+// Capabilities returns the task types which can be executed by this process,
+// with the max number of tasks of each type to run at once, by name.
+func Capabilities(maxConcurrent map[string]int) []packets.Capability {
+	var caps []packets.Capability
+	for _, def := range All() {
+		if def.Execute != nil {
+			caps = append(caps, packets.Capability{
+				TaskType:      def.ID,
+				Version:       def.Version,
+				MaxConcurrent: maxConcurrent[def.Name],
+			})
+		}
+	}
+	return caps
+}
+
+func Describe(id packets.TaskType) string {
+	def, err := Lookup(id)
+	if err != nil {
+		return "Unknown task type"
+	}
+	return def.Description
+}
+
+// EstimateLoad returns the load of the task as per its task type.
+func EstimateLoad(t *packets.TaskPacket) (uint64, error) {
+	def, err := Lookup(t.TaskTypeID)
+	if err != nil {
+		return 0, err
+	}
+	return def.Load(t), nil
+}
+
+// Execute runs the task using the executor of its task type.
+func Execute(ctx context.Context, t *packets.TaskPacket) error {
+	def, err := Lookup(t.TaskTypeID)
+	if err != nil {
+		return err
+	}
+	if def.Execute == nil {
+		return ErrNoExecutor
+	}
+	return def.Execute(ctx, t)
+}
+
+// NewTask creates a task of the given type after validating the arguments
+// against the schema of the task type. The argument "n" is also set in
+// TaskPacket.N.
+func NewTask(name string, args map[string]string) (*packets.TaskPacket, error) {
+	def, err := LookupByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := def.ValidateArgs(args); err != nil {
+		return nil, err
+	}
+
+	t := &packets.TaskPacket{
+		TaskTypeID: def.ID,
+		Args:       args,
+		Close:      make(chan struct{}),
+	}
+	if n, ok := args["n"]; ok {
+		t.N, _ = strconv.Atoi(n)
+	}
+	return t, nil
+}
+
+// ValidateArgs checks that all required arguments are present,
+// all arguments are known and have the correct kind and bounds.
+func (def *Definition) ValidateArgs(args map[string]string) error {
+	known := make(map[string]Field)
+	for _, f := range def.Args {
+		known[f.Name] = f
+		if _, ok := args[f.Name]; f.Required && !ok {
+			return errors.New("Missing argument: " + f.Name)
+		}
+	}
+	for name, val := range args {
+		f, ok := known[name]
+		if !ok {
+			return errors.New("Unknown argument: " + name)
+		}
+		var err error
+		switch f.Kind {
+		case IntField:
+			var v int64
+			v, err = strconv.ParseInt(val, 10, 64)
+			if err == nil && f.bounded() && (v < f.Min || v > f.Max) {
+				return f.boundsError()
+			}
+		case UintField:
+			var v uint64
+			v, err = strconv.ParseUint(val, 10, 64)
+			if err == nil && f.bounded() && (v > math.MaxInt64 || int64(v) < f.Min || int64(v) > f.Max) {
+				return f.boundsError()
+			}
+		}
+		if err != nil {
+			return errors.New("Invalid value for argument " + name + ": " + val)
+		}
+	}
+	return nil
+}
+
+func (f Field) bounded() bool {
+	return f.Min != 0 || f.Max != 0
+}
+
+func (f Field) boundsError() error {
+	return errors.New("Argument " + f.Name + " must be between " +
+		strconv.FormatInt(f.Min, 10) + " and " + strconv.FormatInt(f.Max, 10))
+}
@@ -1,109 +1,460 @@
 package master
 
 import (
-	"errors"
+	"hash/fnv"
+	"math/bits"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
 )
 
-type LoadBalancerInterface interface {
-	assignTask(load uint64) (*Slave, error)
+func init() {
+	MustRegisterAlgorithm("first_available", func() LoadBalancer { return &FirstAvailable{} })
+	MustRegisterAlgorithm("round_robin", func() LoadBalancer { return &RoundRobin{lastAssigned: -1} })
+	MustRegisterAlgorithm("least_difference", func() LoadBalancer { return &LeastDifference{} })
+	MustRegisterAlgorithm("least_load", func() LoadBalancer { return &LeastLoad{} })
+	MustRegisterAlgorithm("weighted_round_robin", func() LoadBalancer { return &WeightedRoundRobin{lastAssigned: -1} })
+	MustRegisterAlgorithm("smooth_weighted_round_robin", func() LoadBalancer { return &SmoothWeightedRoundRobin{} })
+	MustRegisterAlgorithm("random", func() LoadBalancer { return &Random{} })
+	MustRegisterAlgorithm("p2c", func() LoadBalancer { return &PowerOfTwoChoices{} })
+	MustRegisterAlgorithm("consistent_hash", func() LoadBalancer { return &ConsistentHash{} })
+	MustRegisterAlgorithm("least_latency", func() LoadBalancer { return &LeastLatency{} })
 }
 
-type LoadBalancerBase struct {
-	slavePool *SlavePool
-}
+// maxDerivedWeight is the weight of the slave with the biggest max load,
+// when weights are derived from the max load.
+const maxDerivedWeight = 100
+
+// slaveWeights returns the weights of the slaves. The weight set by the
+// operator is used if present, or else the weight is the max load of the
+// slave scaled to 1..maxDerivedWeight.
+func slaveWeights(slaves []SlaveInfo) []int64 {
+	var biggest uint64
+	for _, s := range slaves {
+		if s.MaxLoad > biggest {
+			biggest = s.MaxLoad
+		}
+	}
 
-type FirstAvailable struct {
-	*LoadBalancerBase
+	weights := make([]int64, len(slaves))
+	for i, s := range slaves {
+		if s.Weight != 0 {
+			weights[i] = int64(s.Weight)
+		} else if s.MaxLoad > 0 {
+			// The product can overflow, so it is kept in 128 bits.
+			// It is below biggest<<64, so the quotient fits.
+			hi, lo := bits.Mul64(s.MaxLoad, maxDerivedWeight)
+			q, _ := bits.Div64(hi, lo, biggest)
+			weights[i] = int64(q)
+			if weights[i] == 0 {
+				weights[i] = 1
+			}
+		}
+	}
+	return weights
 }
 
-func (l *FirstAvailable) assignTask(load uint64) (*Slave, error) {
-	l.slavePool.mtx.RLock()
-	defer l.slavePool.mtx.RUnlock()
-	for i := range l.slavePool.slaves {
-		if l.slavePool.slaves[i].currentLoad+load <= l.slavePool.slaves[i].maxLoad {
-			return l.slavePool.slaves[i], nil
+type FirstAvailable struct{}
+
+func (l *FirstAvailable) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	for i := range slaves {
+		if slaves[i].Fits(t) {
+			return i, nil
 		}
 	}
-	return nil, errors.New("No Slave can currently take this load")
+	return -1, ErrNoSlaveForLoad
 }
 
 type RoundRobin struct {
-	*LoadBalancerBase
+	mtx          sync.Mutex
 	lastAssigned int
 }
 
-func (r *RoundRobin) assignTask(load uint64) (*Slave, error) {
-	r.slavePool.mtx.RLock()
-	defer r.slavePool.mtx.RUnlock()
+func (r *RoundRobin) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
 
-	if len(r.slavePool.slaves) == 0 {
-		return nil, errors.New("No Slaves available")
+	if len(slaves) == 0 {
+		return -1, ErrNoSlaves
 	}
-	if len(r.slavePool.slaves) == 1 {
-		if r.slavePool.slaves[0].currentLoad+load <= r.slavePool.slaves[0].maxLoad {
+	if len(slaves) == 1 {
+		if slaves[0].Fits(t) {
 			r.lastAssigned = 0
-			return r.slavePool.slaves[0], nil
+			return 0, nil
 		}
 	}
-	nextIdTry := (r.lastAssigned + 1) % len(r.slavePool.slaves)
-	if r.slavePool.slaves[nextIdTry].currentLoad+load <= r.slavePool.slaves[nextIdTry].maxLoad {
+	nextIdTry := (r.lastAssigned + 1) % len(slaves)
+	if slaves[nextIdTry].Fits(t) {
 		r.lastAssigned = nextIdTry
-		return r.slavePool.slaves[nextIdTry], nil
+		return nextIdTry, nil
 	}
-	for id := (nextIdTry + 1) % len(r.slavePool.slaves); id != nextIdTry; id = (id + 1) % len(r.slavePool.slaves) {
-		if r.slavePool.slaves[id].currentLoad+load <= r.slavePool.slaves[id].maxLoad {
-			return r.slavePool.slaves[id], nil
+	for id := (nextIdTry + 1) % len(slaves); id != nextIdTry; id = (id + 1) % len(slaves) {
+		if slaves[id].Fits(t) {
+			return id, nil
 		}
 	}
-	return nil, errors.New("No Slaves available for this load")
+	return -1, ErrNoSlaveForLoad
 }
 
-type LeastDifference struct {
-	*LoadBalancerBase
+func (r *RoundRobin) State() map[string]interface{} {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return map[string]interface{}{"last_assigned": r.lastAssigned}
 }
 
-func (l *LeastDifference) assignTask(load uint64) (*Slave, error) {
-	l.slavePool.mtx.RLock()
-	defer l.slavePool.mtx.RUnlock()
+type LeastDifference struct{}
 
-	if len(l.slavePool.slaves) == 0 {
-		return nil, errors.New("No Slaves available")
+func (l *LeastDifference) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	if len(slaves) == 0 {
+		return -1, ErrNoSlaves
 	}
-	minDifference := l.slavePool.slaves[0].maxLoad - l.slavePool.slaves[0].currentLoad
+	var minDifference uint64
 	minId := -1
-	for id := 0; id < len(l.slavePool.slaves); id++ {
-		if l.slavePool.slaves[id].maxLoad-l.slavePool.slaves[id].currentLoad <= minDifference && l.slavePool.slaves[id].maxLoad-l.slavePool.slaves[id].currentLoad >= load {
-			minDifference = l.slavePool.slaves[id].currentLoad
+	for id := 0; id < len(slaves); id++ {
+		if !slaves[id].Fits(t) {
+			continue
+		}
+		if minId < 0 || slaves[id].FreeLoad() <= minDifference {
+			minDifference = slaves[id].FreeLoad()
 			minId = id
 		}
 	}
 	if minId >= 0 {
-		return l.slavePool.slaves[minId], nil
+		return minId, nil
 	}
-	return nil, errors.New("No Slaves available for this load")
-}
-
-type LeastLoad struct {
-	*LoadBalancerBase
+	return -1, ErrNoSlaveForLoad
 }
 
-func (l *LeastLoad) assignTask(load uint64) (*Slave, error) {
-	l.slavePool.mtx.RLock()
-	defer l.slavePool.mtx.RUnlock()
+type LeastLoad struct{}
 
-	if len(l.slavePool.slaves) == 0 {
-		return nil, errors.New("No Slaves available")
+func (l *LeastLoad) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	if len(slaves) == 0 {
+		return -1, ErrNoSlaves
 	}
-	minLoad := l.slavePool.slaves[0].currentLoad
+	var minLoad uint64
 	minId := -1
-	for id := 0; id < len(l.slavePool.slaves); id++ {
-		if l.slavePool.slaves[id].currentLoad <= minLoad && l.slavePool.slaves[id].maxLoad >= load {
-			minLoad = l.slavePool.slaves[id].currentLoad
+	for id := 0; id < len(slaves); id++ {
+		if !slaves[id].Fits(t) {
+			continue
+		}
+		if minId < 0 || slaves[id].Load <= minLoad {
+			minLoad = slaves[id].Load
 			minId = id
 		}
 	}
 	if minId >= 0 {
-		return l.slavePool.slaves[minId], nil
+		return minId, nil
+	}
+	return -1, ErrNoSlaveForLoad
+}
+
+// WeightedRoundRobin is interleaved weighted round robin: in every round a
+// slave is chosen as many times as its weight (relative to other slaves).
+type WeightedRoundRobin struct {
+	mtx           sync.Mutex
+	lastAssigned  int
+	currentWeight int64
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func (r *WeightedRoundRobin) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	n := len(slaves)
+	if n == 0 {
+		return -1, ErrNoSlaves
+	}
+
+	// Slaves which cannot take the task get weight 0 for this round.
+	weights := slaveWeights(slaves)
+	var maxWeight, g int64
+	for i, s := range slaves {
+		if w := weights[i]; w > 0 && s.Fits(t) {
+			if w > maxWeight {
+				maxWeight = w
+			}
+			g = gcd(g, w)
+		} else {
+			weights[i] = 0
+		}
+	}
+	if maxWeight == 0 {
+		return -1, ErrNoSlaveForLoad
+	}
+
+	if r.lastAssigned >= n {
+		r.lastAssigned = -1
+	}
+	if r.currentWeight > maxWeight {
+		r.currentWeight = maxWeight
+	}
+	// One full round is enough to find a slave.
+	for steps := int64(0); steps <= int64(n)*(maxWeight/g); steps++ {
+		r.lastAssigned = (r.lastAssigned + 1) % n
+		if r.lastAssigned == 0 {
+			r.currentWeight -= g
+			if r.currentWeight <= 0 {
+				r.currentWeight = maxWeight
+			}
+		}
+		if weights[r.lastAssigned] >= r.currentWeight {
+			return r.lastAssigned, nil
+		}
+	}
+	return -1, ErrNoSlaveForLoad
+}
+
+func (r *WeightedRoundRobin) State() map[string]interface{} {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return map[string]interface{}{
+		"last_assigned":  r.lastAssigned,
+		"current_weight": r.currentWeight,
+	}
+}
+
+// SmoothWeightedRoundRobin is the smooth weighted round robin of nginx,
+// which spreads the picks of a heavy slave evenly within a round.
+type SmoothWeightedRoundRobin struct {
+	mtx sync.Mutex
+	// keyed by SlaveInfo.Key
+	currentWeights map[string]int64
+}
+
+func (r *SmoothWeightedRoundRobin) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if len(slaves) == 0 {
+		return -1, ErrNoSlaves
+	}
+	if r.currentWeights == nil {
+		r.currentWeights = make(map[string]int64)
+	}
+
+	best := -1
+	var total int64
+	weights := slaveWeights(slaves)
+	present := make(map[string]struct{})
+	for i, s := range slaves {
+		key := s.Key()
+		present[key] = struct{}{}
+		w := weights[i]
+		if w <= 0 || !s.Fits(t) {
+			continue
+		}
+		r.currentWeights[key] += w
+		total += w
+		if best < 0 || r.currentWeights[key] > r.currentWeights[slaves[best].Key()] {
+			best = i
+		}
+	}
+
+	// Forget slaves which left the pool.
+	for key := range r.currentWeights {
+		if _, ok := present[key]; !ok {
+			delete(r.currentWeights, key)
+		}
+	}
+
+	if best < 0 {
+		return -1, ErrNoSlaveForLoad
+	}
+	r.currentWeights[slaves[best].Key()] -= total
+	return best, nil
+}
+
+func (r *SmoothWeightedRoundRobin) State() map[string]interface{} {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	weights := make(map[string]int64)
+	for key, w := range r.currentWeights {
+		weights[key] = w
+	}
+	return map[string]interface{}{"current_weights": weights}
+}
+
+// randomPicker gives random numbers to the randomised algorithms.
+type randomPicker struct {
+	mtx sync.Mutex
+	rng *rand.Rand
+}
+
+// pick returns the indexes of up to k distinct random slaves which can take the task.
+func (p *randomPicker) pick(slaves []SlaveInfo, t TaskInfo, k int) []int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.rng == nil {
+		p.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	// Lazy Fisher-Yates shuffle, stopped as soon as k slaves are found.
+	idx := make([]int, len(slaves))
+	for i := range idx {
+		idx[i] = i
+	}
+	picked := make([]int, 0, k)
+	for i := 0; i < len(idx) && len(picked) < k; i++ {
+		j := i + p.rng.Intn(len(idx)-i)
+		idx[i], idx[j] = idx[j], idx[i]
+		if slaves[idx[i]].Fits(t) {
+			picked = append(picked, idx[i])
+		}
+	}
+	return picked
+}
+
+// Random sends the task to a random slave which can take it.
+type Random struct {
+	randomPicker
+}
+
+func (r *Random) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	if len(slaves) == 0 {
+		return -1, ErrNoSlaves
+	}
+	picked := r.pick(slaves, t, 1)
+	if len(picked) == 0 {
+		return -1, ErrNoSlaveForLoad
+	}
+	return picked[0], nil
+}
+
+// PowerOfTwoChoices picks two random slaves and sends the task to the less
+// loaded of them. Unlike LeastLoad, slaves which looked least loaded in a
+// stale load report do not get all the tasks till the next report.
+type PowerOfTwoChoices struct {
+	randomPicker
+}
+
+// lessLoaded tells if a is less loaded than b, relative to their max loads.
+func lessLoaded(a, b SlaveInfo) bool {
+	// a.Load/a.MaxLoad < b.Load/b.MaxLoad without dividing.
+	return float64(a.Load)*float64(b.MaxLoad) < float64(b.Load)*float64(a.MaxLoad)
+}
+
+func (p *PowerOfTwoChoices) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	if len(slaves) == 0 {
+		return -1, ErrNoSlaves
+	}
+	picked := p.pick(slaves, t, 2)
+	switch len(picked) {
+	case 0:
+		return -1, ErrNoSlaveForLoad
+	case 1:
+		return picked[0], nil
+	}
+	if lessLoaded(slaves[picked[1]], slaves[picked[0]]) {
+		return picked[1], nil
+	}
+	return picked[0], nil
+}
+
+// ConsistentHash sends tasks with the same affinity key to the same slave,
+// using rendezvous hashing: every slave gets a score for the key and the
+// slave with the highest score wins. Only the keys of a slave which joins
+// or leaves the pool move. If the preferred slave cannot take the load,
+// the task spills over to the slave with the next highest score.
+type ConsistentHash struct{}
+
+// affinityKey returns the key of the task for consistent hashing.
+func affinityKey(t TaskInfo) string {
+	if t.AffinityKey != "" {
+		return t.AffinityKey
+	}
+	// Same input, same key.
+	key := strconv.Itoa(int(t.Type))
+	for _, name := range sortedKeys(t.Args) {
+		key += "\x00" + name + "=" + t.Args[name]
+	}
+	return key
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// mix64 is the finalizer of splitmix64, so that scores of similar
+// keys and slaves are not correlated.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (c *ConsistentHash) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	if len(slaves) == 0 {
+		return -1, ErrNoSlaves
+	}
+
+	keyHash := hashString(affinityKey(t))
+	best := -1
+	var bestScore uint64
+	for i, s := range slaves {
+		if !s.Fits(t) {
+			continue
+		}
+		score := mix64(keyHash ^ hashString(s.Key()))
+		if best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		return -1, ErrNoSlaveForLoad
+	}
+	return best, nil
+}
+
+// LeastLatency sends the task to the slave expected to finish it soonest,
+// going by the peak EWMA of the latency of the task type on the slave,
+// scaled up by how loaded the slave is. Slaves which have not run the
+// task type yet are tried first, so that every slave gets measured.
+type LeastLatency struct{}
+
+// expectedLatency returns the cost of sending the task to the slave.
+func expectedLatency(s SlaveInfo, t TaskInfo) float64 {
+	l, ok := s.Latency[t.Type]
+	if !ok {
+		return 0
+	}
+	utilisation := 0.0
+	if s.MaxLoad > 0 {
+		utilisation = float64(s.Load) / float64(s.MaxLoad)
+	}
+	return float64(l.PeakEWMA) * (1 + utilisation)
+}
+
+func (l *LeastLatency) Assign(t TaskInfo, slaves []SlaveInfo) (int, error) {
+	if len(slaves) == 0 {
+		return -1, ErrNoSlaves
+	}
+
+	best := -1
+	var bestCost float64
+	for i, s := range slaves {
+		if !s.Fits(t) {
+			continue
+		}
+		cost := expectedLatency(s, t)
+		if best < 0 || cost < bestCost || (cost == bestCost && lessLoaded(s, slaves[best])) {
+			best, bestCost = i, cost
+		}
+	}
+	if best < 0 {
+		return -1, ErrNoSlaveForLoad
 	}
-	return nil, errors.New("No Slaves available for this load")
+	return best, nil
 }
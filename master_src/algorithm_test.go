@@ -0,0 +1,88 @@
+package master
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestLeastLoadSkipsIneligibleFirstSlave(t *testing.T) {
+	slaves := []SlaveInfo{
+		// Idle but draining.
+		{ID: 1, Load: 0, MaxLoad: 100, Eligible: false},
+		{ID: 2, Load: 50, MaxLoad: 100, Eligible: true},
+		{ID: 3, Load: 30, MaxLoad: 100, Eligible: true},
+	}
+	i, err := (&LeastLoad{}).Assign(TaskInfo{Load: 10}, slaves)
+	if err != nil || i != 2 {
+		t.Fatalf("least_load = %d, %v, want 2, nil", i, err)
+	}
+}
+
+func TestLeastLoadUsesEffectiveLoad(t *testing.T) {
+	slaves := []SlaveInfo{
+		{ID: 1, Load: 95, MaxLoad: 100, Eligible: true},
+	}
+	if i, err := (&LeastLoad{}).Assign(TaskInfo{Load: 10}, slaves); err != ErrNoSlaveForLoad {
+		t.Fatalf("least_load on a full slave = %d, %v, want %v", i, err, ErrNoSlaveForLoad)
+	}
+}
+
+func TestLeastDifference(t *testing.T) {
+	slaves := []SlaveInfo{
+		{ID: 1, Load: 0, MaxLoad: 15, Eligible: false},
+		{ID: 2, Load: 0, MaxLoad: 100, Eligible: true},
+		{ID: 3, Load: 70, MaxLoad: 100, Eligible: true},
+		{ID: 4, Load: 60, MaxLoad: 100, Eligible: true},
+		{ID: 5, Load: 95, MaxLoad: 100, Eligible: true},
+	}
+	// Slave 3 has the least free load which still fits the task.
+	i, err := (&LeastDifference{}).Assign(TaskInfo{Load: 20}, slaves)
+	if err != nil || i != 2 {
+		t.Fatalf("least_difference = %d, %v, want 2, nil", i, err)
+	}
+}
+
+func TestConsistentHashKeepsKeysAcrossReconnect(t *testing.T) {
+	before := []SlaveInfo{
+		{ID: 1, IP: "10.0.0.1", SlaveID: "a", MaxLoad: 100, Eligible: true},
+		{ID: 2, IP: "10.0.0.2", SlaveID: "b", MaxLoad: 100, Eligible: true},
+		{ID: 3, IP: "10.0.0.3", SlaveID: "c", MaxLoad: 100, Eligible: true},
+	}
+	// Every slave connected again, with new ids and addresses.
+	after := []SlaveInfo{
+		{ID: 7, IP: "10.0.1.3", SlaveID: "c", MaxLoad: 100, Eligible: true},
+		{ID: 8, IP: "10.0.1.1", SlaveID: "a", MaxLoad: 100, Eligible: true},
+		{ID: 9, IP: "10.0.1.2", SlaveID: "b", MaxLoad: 100, Eligible: true},
+	}
+	lb := &ConsistentHash{}
+	for i := 0; i < 50; i++ {
+		task := TaskInfo{Load: 1, AffinityKey: "key-" + strconv.Itoa(i)}
+		x, err := lb.Assign(task, before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := lb.Assign(task, after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before[x].SlaveID != after[y].SlaveID {
+			t.Fatalf("key %q moved from slave %s to %s on reconnect", task.AffinityKey, before[x].SlaveID, after[y].SlaveID)
+		}
+	}
+}
+
+func TestSlaveWeightsWithHugeMaxLoad(t *testing.T) {
+	slaves := []SlaveInfo{
+		{ID: 1, MaxLoad: ^uint64(0)},
+		{ID: 2, MaxLoad: ^uint64(0)/2 + 1},
+		{ID: 3, MaxLoad: 1},
+		{ID: 4, MaxLoad: 100, Weight: 7},
+	}
+	want := []int64{maxDerivedWeight, maxDerivedWeight / 2, 1, 7}
+	got := slaveWeights(slaves)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("weight of slave %d = %d, want %d", slaves[i].ID, got[i], want[i])
+		}
+	}
+}
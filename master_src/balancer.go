@@ -0,0 +1,294 @@
+package master
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+var (
+	ErrNoSlaves         = errors.New("No Slaves available")
+	ErrNoSlaveForLoad   = errors.New("No Slaves available for this load")
+	ErrNoCapableSlave   = errors.New("No capable slave for this task")
+	ErrUnknownAlgorithm = errors.New("Unknown algorithm")
+	ErrAlgorithmExists  = errors.New("Algorithm already registered")
+)
+
+// LoadBalancer chooses the slave for a task. It is given a snapshot of all
+// slaves in the pool, which it must not modify, and returns the index in
+// slaves of the chosen slave. Only a slave marked Eligible may be chosen.
+// Assign may be called from many goroutines at once.
+type LoadBalancer interface {
+	Assign(t TaskInfo, slaves []SlaveInfo) (int, error)
+}
+
+// LoadBalancerState is implemented by load balancers which keep state
+// between tasks, to show it on the admin API.
+type LoadBalancerState interface {
+	State() map[string]interface{}
+}
+
+// TaskInfo is the description of a task given to a LoadBalancer.
+type TaskInfo struct {
+	ID       int
+	Type     packets.TaskType
+	Args     map[string]string
+	Load     uint64
+	Priority int
+	Tenant   string
+	Class    PriorityClass
+	// AffinityKey is the key given with the task, may be empty.
+	AffinityKey string
+	// Deadline is zero if the task has no deadline.
+	Deadline time.Time
+	// Selector of the task. Slaves without the required labels are
+	// never Eligible.
+	Selector LabelSelector
+}
+
+// SlaveInfo is the state of a slave at the time of a task assignment.
+type SlaveInfo struct {
+	ID uint16
+	IP string
+	// SlaveID is chosen by the slave and stays the same when it connects
+	// again, unlike ID and IP.
+	SlaveID string
+	// Load is the load last reported by the slave, corrected by the
+	// tasks sent to it and finished since that report.
+	Load    uint64
+	MaxLoad uint64
+	// Labels advertised by the slave.
+	Labels map[string]string
+	// Healthy is false if the slave is not trusted with tasks right now,
+	// e.g. it rejected a task after its last load report.
+	Healthy bool
+	// Eligible tells if the slave may be given this task at all.
+	Eligible bool
+	// Weight set by the operator for the slave, 0 if not set.
+	Weight int
+	// Latency of the task types which finished on the slave.
+	Latency map[packets.TaskType]LatencyStats
+}
+
+// Key identifies the slave across reconnections, so that state kept by
+// a load balancer still applies to it. It is the SlaveID if the slave
+// sent one, and IP:ID otherwise.
+func (s SlaveInfo) Key() string {
+	if s.SlaveID != "" {
+		return s.SlaveID
+	}
+	return s.IP + ":" + strconv.Itoa(int(s.ID))
+}
+
+// FreeLoad is the load the slave can still take.
+func (s SlaveInfo) FreeLoad() uint64 {
+	if s.Load >= s.MaxLoad {
+		return 0
+	}
+	return s.MaxLoad - s.Load
+}
+
+// Fits tells if the task can be given to the slave right now.
+func (s SlaveInfo) Fits(t TaskInfo) bool {
+	return s.Eligible && t.Load <= s.FreeLoad()
+}
+
+var (
+	algorithmsMtx  sync.RWMutex
+	algorithms     = make(map[string]func() LoadBalancer)
+	algorithmNames []string
+)
+
+// RegisterAlgorithm makes a load balancing algorithm available under the
+// name, for Master.Run and the admin API. factory is called every time
+// the algorithm is chosen.
+func RegisterAlgorithm(name string, factory func() LoadBalancer) error {
+	algorithmsMtx.Lock()
+	defer algorithmsMtx.Unlock()
+	if _, ok := algorithms[name]; ok {
+		return ErrAlgorithmExists
+	}
+	algorithms[name] = factory
+	algorithmNames = append(algorithmNames, name)
+	return nil
+}
+
+// MustRegisterAlgorithm is like RegisterAlgorithm but panics on error.
+func MustRegisterAlgorithm(name string, factory func() LoadBalancer) {
+	if err := RegisterAlgorithm(name, factory); err != nil {
+		panic(err.Error() + ": " + name)
+	}
+}
+
+// Algorithms returns the names of the registered algorithms, in the order
+// they were registered.
+func Algorithms() []string {
+	algorithmsMtx.RLock()
+	defer algorithmsMtx.RUnlock()
+	return append([]string(nil), algorithmNames...)
+}
+
+// NewLoadBalancer creates a load balancer running the named algorithm.
+func NewLoadBalancer(name string) (LoadBalancer, error) {
+	algorithmsMtx.RLock()
+	factory, ok := algorithms[name]
+	algorithmsMtx.RUnlock()
+	if !ok {
+		return nil, ErrUnknownAlgorithm
+	}
+	return factory(), nil
+}
+
+// setLoadBalancer makes lb the load balancer for all tasks assigned from now on.
+// Tasks already sent to slaves are not affected.
+func (m *Master) setLoadBalancer(algo string, lb LoadBalancer) {
+	m.loadBalancerMtx.Lock()
+	defer m.loadBalancerMtx.Unlock()
+	m.algorithm = algo
+	m.loadBalancer = lb
+}
+
+func (m *Master) getLoadBalancer() (string, LoadBalancer) {
+	m.loadBalancerMtx.RLock()
+	defer m.loadBalancerMtx.RUnlock()
+	return m.algorithm, m.loadBalancer
+}
+
+// taskInfo returns the description of the task for load balancers.
+func taskInfo(t *MasterTask) TaskInfo {
+	return TaskInfo{
+		ID:          t.TaskId,
+		Type:        t.Task.TaskTypeID,
+		Args:        copyLabels(t.Task.Args),
+		Load:        t.Load,
+		Priority:    t.Priority,
+		Tenant:      t.Tenant,
+		Class:       t.Class,
+		AffinityKey: t.AffinityKey,
+		Deadline:    t.Deadline,
+		Selector:    t.Selector.copy(),
+	}
+}
+
+// slaveWeight returns the weight set by the operator for the slave, 0 if not set.
+func (m *Master) slaveWeight(s *Slave) int {
+	m.weightsMtx.RLock()
+	defer m.weightsMtx.RUnlock()
+	if w, ok := m.SlaveWeights[s.slaveID]; ok && s.slaveID != "" {
+		return w
+	}
+	if w, ok := m.SlaveWeights[s.ip+":"+strconv.Itoa(int(s.id))]; ok {
+		return w
+	}
+	return m.SlaveWeights[s.ip]
+}
+
+func (m *Master) getSlaveWeights() map[string]int {
+	m.weightsMtx.RLock()
+	defer m.weightsMtx.RUnlock()
+	weights := make(map[string]int, len(m.SlaveWeights))
+	for k, w := range m.SlaveWeights {
+		weights[k] = w
+	}
+	return weights
+}
+
+// setSlaveWeights replaces the weights of all slaves, for tasks assigned
+// from now on.
+func (m *Master) setSlaveWeights(weights map[string]int) {
+	m.weightsMtx.Lock()
+	defer m.weightsMtx.Unlock()
+	m.SlaveWeights = weights
+}
+
+// snapshot returns the slaves in the pool and their state for the task.
+// The infos share no maps with the slaves, so load balancers can keep them.
+func (m *Master) snapshot(t *MasterTask) ([]*Slave, []SlaveInfo) {
+	m.slavePool.mtx.RLock()
+	slaves := append([]*Slave(nil), m.slavePool.slaves...)
+	m.slavePool.mtx.RUnlock()
+
+	infos := make([]SlaveInfo, len(slaves))
+	for i, s := range slaves {
+		s.mtx.RLock()
+		healthy := !s.loadStale
+		maxLoad := s.maxLoad
+		labels := copyLabels(s.labels)
+		s.mtx.RUnlock()
+		healthy = healthy && s.breaker.getState() == breakerClosed && s.heartbeat.getState() == slaveAlive
+		infos[i] = SlaveInfo{
+			ID:       s.id,
+			IP:       s.ip,
+			SlaveID:  s.slaveID,
+			Load:     s.effectiveLoad(),
+			MaxLoad:  maxLoad,
+			Labels:   labels,
+			Healthy:  healthy,
+			Eligible: s.eligible(t),
+			Weight:   m.slaveWeight(s),
+			Latency:  s.latencySnapshot(),
+		}
+	}
+	return slaves, infos
+}
+
+// chooseSlave asks the load balancer for the slave to send the task to.
+func (m *Master) chooseSlave(t *MasterTask) (*Slave, error) {
+	_, lb := m.getLoadBalancer()
+	slaves, infos := m.snapshot(t)
+	i, err := assignPreferred(lb, taskInfo(t), infos)
+	if err != nil {
+		for _, s := range slaves {
+			if s.capable(t) {
+				return nil, err
+			}
+		}
+		return nil, ErrNoCapableSlave
+	}
+	if i < 0 || i >= len(infos) || !infos[i].Eligible {
+		return nil, errors.New("Load balancer chose an ineligible slave")
+	}
+	return slaves[i], nil
+}
+
+// hasCapableSlave tells if any slave in the pool could run the task.
+func (m *Master) hasCapableSlave(t *MasterTask) bool {
+	m.slavePool.mtx.RLock()
+	defer m.slavePool.mtx.RUnlock()
+	for _, s := range m.slavePool.slaves {
+		if s.capable(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// largestMaxLoad returns the biggest max load of the slaves, or false if no
+// slave has reported its max load yet.
+func (m *Master) largestMaxLoad() (uint64, bool) {
+	m.slavePool.mtx.RLock()
+	defer m.slavePool.mtx.RUnlock()
+	var biggest uint64
+	for _, s := range m.slavePool.slaves {
+		s.mtx.RLock()
+		if s.maxLoad > biggest {
+			biggest = s.maxLoad
+		}
+		s.mtx.RUnlock()
+	}
+	return biggest, biggest > 0
+}
+
+// sortedKeys returns the keys of the map in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,39 @@
+package master
+
+import (
+	"testing"
+
+	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+func TestSnapshotSharesNoMaps(t *testing.T) {
+	m := newTestMaster(t)
+	s := addTestSlave(m, 1, "a")
+	s.setLabels(map[string]string{"zone": "a"})
+	task := &MasterTask{
+		Task:     &packets.TaskPacket{TaskTypeID: tasks.FibonacciTaskType, Args: map[string]string{"n": "10"}},
+		Selector: LabelSelector{Required: map[string]string{"zone": "a"}},
+	}
+
+	_, infos := m.snapshot(task)
+	infos[0].Labels["zone"] = "b"
+	info := taskInfo(task)
+	info.Args["n"] = "20"
+	info.Selector.Required["zone"] = "b"
+
+	if !task.Selector.Allows(s.labels) || task.Task.Args["n"] != "10" {
+		t.Fatalf("changing the snapshot changed the slave labels %v or the task %v %v",
+			s.labels, task.Task.Args, task.Selector.Required)
+	}
+}
+
+func TestFitsDoesNotOverflow(t *testing.T) {
+	s := SlaveInfo{Load: 10, MaxLoad: 100, Eligible: true}
+	if s.Fits(TaskInfo{Load: ^uint64(0) - 5}) {
+		t.Fatal("a task with a huge load fits a slave with a max load of 100")
+	}
+	if !s.Fits(TaskInfo{Load: 90}) {
+		t.Fatal("a task of the free load does not fit")
+	}
+}
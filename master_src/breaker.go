@@ -0,0 +1,160 @@
+package master
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/logger"
+)
+
+type breakerState int
+
+const (
+	// lets tasks through
+	breakerClosed breakerState = iota
+	// keeps tasks away from the slave till BreakerOpenTime passes
+	breakerOpen
+	// lets one trial task through, the next success closes the
+	// breaker and the next failure opens it again
+	breakerHalfOpen
+)
+
+func (b breakerState) String() string {
+	switch b {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return ""
+	}
+}
+
+// circuitBreaker trips on BreakerConsecutiveFailures failures in a row, or
+// when the failure rate of the last BreakerWindowSize outcomes reaches
+// BreakerErrorRate. Outcomes are health probes and task results.
+// The zero value is a closed breaker.
+type circuitBreaker struct {
+	mtx         sync.Mutex
+	state       breakerState
+	consecutive int
+	// ring of the last outcomes, true for failures
+	window   [constants.BreakerWindowSize]bool
+	next     int
+	samples  int
+	failures int
+	openedAt time.Time
+	// a trial task was sent while half open
+	trial bool
+}
+
+// allow tells if a task may be sent through the breaker.
+func (b *circuitBreaker) allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= constants.BreakerOpenTime {
+		b.state = breakerHalfOpen
+		b.trial = false
+	}
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		return !b.trial
+	default:
+		return false
+	}
+}
+
+// dispatched records that a task was sent through the breaker.
+func (b *circuitBreaker) dispatched() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.state == breakerHalfOpen {
+		b.trial = true
+	}
+}
+
+// record adds an outcome and returns the state before and after it.
+func (b *circuitBreaker) record(failed bool) (breakerState, breakerState) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	from := b.state
+
+	if b.samples == len(b.window) && b.window[b.next] {
+		b.failures--
+	}
+	b.window[b.next] = failed
+	b.next = (b.next + 1) % len(b.window)
+	if b.samples < len(b.window) {
+		b.samples++
+	}
+	if failed {
+		b.failures++
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+
+	switch b.state {
+	case breakerClosed:
+		if failed && (b.consecutive >= constants.BreakerConsecutiveFailures ||
+			(b.samples >= constants.BreakerMinSamples &&
+				float64(b.failures) >= constants.BreakerErrorRate*float64(b.samples))) {
+			b.trip()
+		}
+	case breakerHalfOpen:
+		if failed {
+			b.trip()
+		} else {
+			b.reset()
+		}
+	}
+	return from, b.state
+}
+
+func (b *circuitBreaker) trip() {
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+	b.trial = false
+}
+
+// reset closes the breaker with a clean history.
+func (b *circuitBreaker) reset() {
+	b.state = breakerClosed
+	b.consecutive = 0
+	b.samples = 0
+	b.failures = 0
+	b.next = 0
+	b.trial = false
+}
+
+func (b *circuitBreaker) getState() breakerState {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= constants.BreakerOpenTime {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// recordOutcome feeds the outcome of a probe or a task to the breaker of the slave.
+func (s *Slave) recordOutcome(failed bool, what string) {
+	from, to := s.breaker.record(failed)
+	if from == to {
+		return
+	}
+	msg := "Circuit breaker closed"
+	if to == breakerOpen {
+		msg = "Circuit breaker opened"
+	}
+	s.Logger.Warning(logger.FormatLogMessage("msg", msg, "slave_ip", s.ip,
+		"slave_id", strconv.Itoa(int(s.id)), "after", what))
+	if to == breakerClosed {
+		s.notifyCapacity()
+	}
+}
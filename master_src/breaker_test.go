@@ -0,0 +1,127 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+// expireOpen makes the breaker look as if it opened BreakerOpenTime ago.
+func expireOpen(b *circuitBreaker) {
+	b.mtx.Lock()
+	b.openedAt = time.Now().Add(-constants.BreakerOpenTime)
+	b.mtx.Unlock()
+}
+
+func TestBreakerOpensAndClosesThroughProbe(t *testing.T) {
+	var b circuitBreaker
+	for i := 1; i < constants.BreakerConsecutiveFailures; i++ {
+		if _, to := b.record(true); to != breakerClosed {
+			t.Fatalf("state after %d failures = %v, want closed", i, to)
+		}
+	}
+	if from, to := b.record(true); from != breakerClosed || to != breakerOpen {
+		t.Fatalf("transition after %d failures = %v -> %v, want closed -> open", constants.BreakerConsecutiveFailures, from, to)
+	}
+	if b.allow() {
+		t.Fatal("open breaker let a task through")
+	}
+
+	expireOpen(&b)
+	if got := b.getState(); got != breakerHalfOpen {
+		t.Fatalf("state after the open time = %v, want half_open", got)
+	}
+	if !b.allow() {
+		t.Fatal("half open breaker did not let the trial through")
+	}
+	b.dispatched()
+	if b.allow() {
+		t.Fatal("half open breaker let a second task through with the trial out")
+	}
+
+	if from, to := b.record(false); from != breakerHalfOpen || to != breakerClosed {
+		t.Fatalf("transition after a successful trial = %v -> %v, want half_open -> closed", from, to)
+	}
+	if !b.allow() {
+		t.Fatal("closed breaker did not let a task through")
+	}
+	// The history was reset, so one more failure does not trip it.
+	if _, to := b.record(true); to != breakerClosed {
+		t.Fatalf("state after one failure on a reset breaker = %v, want closed", to)
+	}
+}
+
+func TestBreakerReopensOnFailedTrial(t *testing.T) {
+	var b circuitBreaker
+	for i := 0; i < constants.BreakerConsecutiveFailures; i++ {
+		b.record(true)
+	}
+	expireOpen(&b)
+	if !b.allow() {
+		t.Fatal("half open breaker did not let the trial through")
+	}
+	b.dispatched()
+	if from, to := b.record(true); from != breakerHalfOpen || to != breakerOpen {
+		t.Fatalf("transition after a failed trial = %v -> %v, want half_open -> open", from, to)
+	}
+	if b.allow() {
+		t.Fatal("reopened breaker let a task through")
+	}
+}
+
+func TestBreakerOpensOnErrorRate(t *testing.T) {
+	var b circuitBreaker
+	// Alternating outcomes never reach the consecutive failures.
+	for i := 0; i < constants.BreakerMinSamples; i++ {
+		b.record(i%2 == 1)
+	}
+	if got := b.getState(); got != breakerOpen {
+		t.Fatalf("state at a %.0f%% failure rate = %v, want open", 100*constants.BreakerErrorRate, got)
+	}
+}
+
+func TestTimedOutAndCancelledResultsDoNotTripBreaker(t *testing.T) {
+	m := newTestMaster(t)
+	s := addTestSlave(m, 1, "a")
+	for i := 0; i < 2*constants.BreakerConsecutiveFailures; i++ {
+		status := packets.TimedOut
+		if i%2 == 1 {
+			status = packets.Cancelled
+		}
+		id := assignTestTask(m, s)
+		s.handleTaskResult(packets.TaskResultResponsePacket{TaskId: id, TaskStatus: status})
+	}
+	if got := s.breaker.getState(); got != breakerClosed {
+		t.Fatalf("breaker after timed out and cancelled tasks = %v, want closed", got)
+	}
+
+	for i := 0; i < constants.BreakerConsecutiveFailures; i++ {
+		id := assignTestTask(m, s)
+		s.handleTaskResult(packets.TaskResultResponsePacket{TaskId: id, TaskStatus: packets.Failed})
+	}
+	if got := s.breaker.getState(); got != breakerOpen {
+		t.Fatalf("breaker after failed tasks = %v, want open", got)
+	}
+}
+
+func TestResultForFinishedTaskIsIgnored(t *testing.T) {
+	m := newTestMaster(t)
+	s := addTestSlave(m, 1, "a")
+	id := assignTestTask(m, s)
+	if !finishTask(id, packets.Cancelled, "") {
+		t.Fatal("finishTask failed")
+	}
+
+	s.handleTaskResult(packets.TaskResultResponsePacket{TaskId: id, TaskStatus: packets.Failed})
+	if got := getTestTask(t, id); got.TaskStatus != packets.Cancelled {
+		t.Fatalf("task status after a late result = %v, want Cancelled", got.TaskStatus)
+	}
+	s.breaker.mtx.Lock()
+	failures := s.breaker.failures
+	s.breaker.mtx.Unlock()
+	if failures != 0 {
+		t.Fatalf("breaker failures after a result for a finished task = %d, want 0", failures)
+	}
+}
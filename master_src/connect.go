@@ -41,7 +41,7 @@ func (m *Master) connect() {
 type connectionReqData struct {
 	n    int
 	addr *net.UDPAddr
-	buf  [2048]byte
+	buf  [constants.MaxConnectPacketSize]byte
 }
 
 func (m *Master) collectIncomingRequests(conn *net.UDPConn, packetChan chan<- connectionReqData) {
@@ -51,14 +51,14 @@ func (m *Master) collectIncomingRequests(conn *net.UDPConn, packetChan chan<- co
 		case <-m.close:
 			end = true
 		default:
-			var buf [2048]byte
+			var buf [constants.MaxConnectPacketSize]byte
 			n, addr, err := conn.ReadFromUDP(buf[0:])
 			if err != nil {
 				m.Logger.Error(logger.FormatLogMessage("msg", "Error in reading from UDP"))
 				continue
 			}
 
-			var bufCopy [2048]byte
+			var bufCopy [constants.MaxConnectPacketSize]byte
 			copy(bufCopy[:], buf[:])
 			packetChan <- connectionReqData{
 				n:    n,
@@ -148,13 +148,21 @@ func (m *Master) handleClient(conn *net.UDPConn, packetChan <-chan connectionReq
 			if _, ok := m.unackedSlaves[p.IP.String()+":"+portStr]; ok {
 				delete(m.unackedSlaves, p.IP.String()+":"+portStr)
 				m.unackedSlaveMtx.Unlock()
-				m.slavePool.AddSlave(&Slave{
-					ip:          p.IP.String(),
-					id:          p.Port,
-					loadReqPort: p.LoadReqPort,
-					reqSendPort: p.ReqSendPort,
-					reqRecvPort: p.ReqRecvPort,
-				})
+				slave := &Slave{
+					ip:           p.IP.String(),
+					id:           p.Port,
+					loadReqPort:  p.LoadReqPort,
+					reqSendPort:  p.ReqSendPort,
+					reqRecvPort:  p.ReqRecvPort,
+					rejectChan:   m.taskRejections,
+					capacityChan: m.dispatchSignal,
+					drainChan:    m.drainRequests,
+					resumeChan:   m.resumeRequests,
+					slaveID:      p.SlaveID,
+				}
+				slave.setCapabilities(p.Capabilities)
+				slave.setLabels(p.Labels)
+				m.slavePool.AddSlave(slave)
 				m.Logger.Info(logger.FormatLogMessage("msg", "Connection request granted", "ip", p.IP.String(), "port", portStr))
 			} else {
 				m.unackedSlaveMtx.Unlock()
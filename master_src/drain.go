@@ -0,0 +1,211 @@
+package master
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/logger"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+var (
+	ErrUnknownSlave    = errors.New("Unknown slave")
+	ErrAlreadyDraining = errors.New("Slave is already draining")
+	ErrMasterClosing   = errors.New("Master is closing")
+)
+
+const (
+	drainRunning  = "draining"
+	drainDone     = "drained"
+	drainTimedOut = "timed_out"
+	// the slave went away before the drain finished
+	drainLost = "lost"
+)
+
+// drainRecord is the progress of the drain of a slave. Records are kept
+// after the slave is removed so the outcome can be looked up.
+type drainRecord struct {
+	slave           *Slave
+	key             string
+	started         time.Time
+	deadline        time.Time
+	finished        time.Time
+	inFlightAtStart int
+	state           string
+}
+
+type drainRequest struct {
+	slave   *Slave
+	timeout time.Duration
+}
+
+type drains struct {
+	mtx     sync.Mutex
+	records map[string]*drainRecord
+}
+
+// removeFinished removes the records of drains which finished before the
+// retention period.
+func (d *drains) removeFinished(now time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for key, r := range d.records {
+		if r.state != drainRunning && now.Sub(r.finished) > constants.FinishedTaskRetention {
+			delete(d.records, key)
+		}
+	}
+}
+
+func (s *Slave) isDraining() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.draining
+}
+
+func (s *Slave) inFlightCount() int {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return len(s.inFlight)
+}
+
+// findSlave returns the slave in the pool with the key "ip:id".
+func (m *Master) findSlave(key string) *Slave {
+	m.slavePool.mtx.RLock()
+	defer m.slavePool.mtx.RUnlock()
+	for _, s := range m.slavePool.slaves {
+		if s.ip+":"+strconv.Itoa(int(s.id)) == key {
+			return s
+		}
+	}
+	return nil
+}
+
+// drainSlave stops assigning tasks to the slave and disconnects it once
+// its in-flight tasks finish. Tasks still running after the timeout are
+// cancelled on the slave and reassigned. constants.DrainTimeout is used
+// if the timeout is 0.
+func (m *Master) drainSlave(s *Slave, timeout time.Duration) (*drainRecord, error) {
+	if timeout <= 0 {
+		timeout = constants.DrainTimeout
+	}
+	s.mtx.Lock()
+	if s.draining {
+		s.mtx.Unlock()
+		return nil, ErrAlreadyDraining
+	}
+	s.draining = true
+	inFlight := len(s.inFlight)
+	s.mtx.Unlock()
+
+	now := time.Now()
+	r := &drainRecord{
+		slave:           s,
+		key:             s.ip + ":" + strconv.Itoa(int(s.id)),
+		started:         now,
+		deadline:        now.Add(timeout),
+		inFlightAtStart: inFlight,
+		state:           drainRunning,
+	}
+	m.drains.mtx.Lock()
+	m.drains.records[r.key] = r
+	m.drains.mtx.Unlock()
+
+	s.Logger.Info(logger.FormatLogMessage("msg", "Draining slave", "slave_ip", s.ip,
+		"slave_id", strconv.Itoa(int(s.id)), "in_flight", strconv.Itoa(inFlight),
+		"timeout", timeout.String()))
+	if !m.goRoutine(func() { m.drainRoutine(r) }) {
+		// The slaves are closed with the master.
+		m.drains.mtx.Lock()
+		r.state = drainLost
+		r.finished = time.Now()
+		m.drains.mtx.Unlock()
+		return nil, ErrMasterClosing
+	}
+	return r, nil
+}
+
+// drainRoutine waits for the in-flight tasks of the draining slave and
+// then closes it. Tasks which did not finish in time are reassigned and
+// cancelled on the slave.
+func (m *Master) drainRoutine(r *drainRecord) {
+	s := r.slave
+	state := ""
+	for state == "" {
+		if s.inFlightCount() == 0 {
+			state = drainDone
+			break
+		}
+		wait := time.Until(r.deadline)
+		if wait <= 0 {
+			state = drainTimedOut
+			break
+		}
+		if wait > constants.DrainCheckInterval {
+			wait = constants.DrainCheckInterval
+		}
+		select {
+		case <-m.close:
+			state = drainLost
+		case <-s.close:
+			state = drainLost
+		case <-time.After(wait):
+		}
+	}
+
+	m.drains.mtx.Lock()
+	r.state = state
+	r.finished = time.Now()
+	m.drains.mtx.Unlock()
+
+	s.Logger.Info(logger.FormatLogMessage("msg", "Drain of slave finished", "slave_ip", s.ip,
+		"slave_id", strconv.Itoa(int(s.id)), "state", state,
+		"in_flight", strconv.Itoa(s.inFlightCount())))
+	if state == drainTimedOut {
+		// Taken from the slave first, so that it reporting them as
+		// cancelled does not finish them.
+		ids := tasksAssignedTo(s)
+		m.reassignTasks(s)
+		for _, id := range ids {
+			pt := packets.CreatePacketTransmit(packets.TaskCancelPacket{TaskId: id}, packets.TaskCancel)
+			s.send(pt)
+		}
+	}
+	if state != drainLost {
+		// Tells the slave to shut down instead of connecting again. The
+		// connections are closed only once it is written.
+		pt := packets.CreatePacketTransmit(packets.DrainPacket{}, packets.Drain)
+		if err := s.sendSync(pt); err != nil {
+			s.Logger.Warning(logger.FormatLogMessage("msg", "Failed to tell slave of drain", "slave_ip", s.ip,
+				"slave_id", strconv.Itoa(int(s.id)), "err", err.Error()))
+		}
+	}
+	s.stop()
+}
+
+// requestDrain passes a drain asked for by the slave to the master.
+func (s *Slave) requestDrain(timeout time.Duration) {
+	select {
+	case s.drainChan <- drainRequest{s, timeout}:
+	case <-s.close:
+	}
+}
+
+// drainRequestRoutine starts the drains asked for by slaves.
+func (m *Master) drainRequestRoutine() {
+	end := false
+	for !end {
+		select {
+		case <-m.close:
+			end = true
+		case req := <-m.drainRequests:
+			if _, err := m.drainSlave(req.slave, req.timeout); err != nil {
+				m.Logger.Warning(logger.FormatLogMessage("msg", "Drain request ignored",
+					"slave_ip", req.slave.ip, "err", err.Error()))
+			}
+		}
+	}
+	m.closeWait.Done()
+}
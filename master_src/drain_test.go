@@ -0,0 +1,73 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+func TestDrainTimeoutCancelsAndReassignsTasks(t *testing.T) {
+	m := newTestMaster(t)
+	s, sent := addRecordingTestSlave(m, 1, "a", 10)
+	id := assignTestTask(m, s)
+
+	r, err := m.drainSlave(s, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, s.close)
+
+	if pt := <-sent; pt.PacketType != packets.TaskCancel || pt.Packet.(packets.TaskCancelPacket).TaskId != id {
+		t.Fatalf("first packet = %v %v, want the cancel of task %d", pt.PacketType, pt.Packet, id)
+	}
+	if pt := <-sent; pt.PacketType != packets.Drain {
+		t.Fatalf("second packet = %v, want the drain", pt.PacketType)
+	}
+	if got := getTestTask(t, id); got.AssignedTo != nil || got.TaskStatus != packets.Unassigned {
+		t.Fatalf("task after drain = %v on %v, want unassigned", got.TaskStatus, got.AssignedTo)
+	}
+
+	// The slave reporting the task as cancelled does not finish it.
+	s.handleTaskResult(packets.TaskResultResponsePacket{TaskId: id, TaskStatus: packets.Cancelled})
+	if got := getTestTask(t, id); got.TaskStatus != packets.Unassigned {
+		t.Fatalf("task after the slave cancelled it = %v, want unassigned", got.TaskStatus)
+	}
+
+	m.drains.mtx.Lock()
+	state := r.state
+	m.drains.mtx.Unlock()
+	if state != drainTimedOut {
+		t.Fatalf("drain state = %s, want %s", state, drainTimedOut)
+	}
+}
+
+func TestDrainAfterCloseIsRefused(t *testing.T) {
+	m := newTestMaster(t)
+	s := addTestSlave(m, 1, "a")
+	close(m.close)
+	if _, err := m.drainSlave(s, time.Second); err != ErrMasterClosing {
+		t.Fatalf("drainSlave after close = %v, want %v", err, ErrMasterClosing)
+	}
+	m.closeWait.Wait()
+}
+
+func TestFinishedDrainRecordsExpire(t *testing.T) {
+	var d drains
+	now := time.Now()
+	d.records = map[string]*drainRecord{
+		"old":     {state: drainDone, finished: now.Add(-constants.FinishedTaskRetention - time.Second)},
+		"recent":  {state: drainTimedOut, finished: now.Add(-time.Second)},
+		"running": {state: drainRunning},
+	}
+	d.removeFinished(now)
+	if _, ok := d.records["old"]; ok {
+		t.Error("record finished before the retention period was kept")
+	}
+	for _, key := range []string{"recent", "running"} {
+		if _, ok := d.records[key]; !ok {
+			t.Errorf("record %q was removed", key)
+		}
+	}
+}
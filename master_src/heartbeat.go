@@ -0,0 +1,171 @@
+package master
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/logger"
+)
+
+type liveness int
+
+const (
+	// heartbeats arrive as expected
+	slaveAlive liveness = iota
+	// heartbeats are late, the slave gets no new tasks
+	slaveSuspect
+	// heartbeats stopped, the slave is evicted
+	slaveDead
+)
+
+func (l liveness) String() string {
+	switch l {
+	case slaveAlive:
+		return "alive"
+	case slaveSuspect:
+		return "suspect"
+	case slaveDead:
+		return "dead"
+	default:
+		return ""
+	}
+}
+
+// heartbeatDetector is a phi accrual failure detector. It keeps the
+// intervals between the last HeartbeatWindowSize heartbeats and tells how
+// unlikely it is, on a log scale, that the next heartbeat is only late.
+// A phi of 1 is a 10% chance of a wrong suspicion, 2 is 1%, and so on.
+type heartbeatDetector struct {
+	mtx sync.Mutex
+	// ring of the last intervals in seconds
+	intervals [constants.HeartbeatWindowSize]float64
+	next      int
+	samples   int
+	sum       float64
+	sumSq     float64
+	last      time.Time
+	state     liveness
+}
+
+// start resets the detector as if a heartbeat just arrived. The history is
+// bootstrapped with HeartbeatInterval so phi is defined right away.
+// It must be called before the detector is shared with other goroutines.
+func (d *heartbeatDetector) start(now time.Time) {
+	*d = heartbeatDetector{last: now}
+	d.add(constants.HeartbeatInterval.Seconds())
+}
+
+func (d *heartbeatDetector) add(interval float64) {
+	if d.samples == len(d.intervals) {
+		old := d.intervals[d.next]
+		d.sum -= old
+		d.sumSq -= old * old
+	} else {
+		d.samples++
+	}
+	d.intervals[d.next] = interval
+	d.next = (d.next + 1) % len(d.intervals)
+	d.sum += interval
+	d.sumSq += interval * interval
+}
+
+// heartbeat records a heartbeat received at now.
+func (d *heartbeatDetector) heartbeat(now time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.state == slaveDead {
+		return
+	}
+	if now.After(d.last) {
+		d.add(now.Sub(d.last).Seconds())
+		d.last = now
+	}
+}
+
+func (d *heartbeatDetector) phiLocked(now time.Time) float64 {
+	mean := d.sum / float64(d.samples)
+	stdDev := math.Sqrt(math.Max(d.sumSq/float64(d.samples)-mean*mean, 0))
+	stdDev = math.Max(stdDev, constants.HeartbeatMinStdDev.Seconds())
+	elapsed := now.Sub(d.last).Seconds()
+
+	// Logistic approximation of the normal CDF, as in Akka.
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+func (d *heartbeatDetector) phi(now time.Time) float64 {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.phiLocked(now)
+}
+
+// check updates the state from phi at now and returns the state before and
+// after. A suspect slave is alive again once phi drops, a dead one stays dead.
+func (d *heartbeatDetector) check(now time.Time, suspectPhi, deadPhi float64) (liveness, liveness) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	from := d.state
+	if d.state == slaveDead {
+		return from, d.state
+	}
+	phi := d.phiLocked(now)
+	switch {
+	case phi >= deadPhi:
+		d.state = slaveDead
+	case phi >= suspectPhi:
+		d.state = slaveSuspect
+	default:
+		d.state = slaveAlive
+	}
+	return from, d.state
+}
+
+func (d *heartbeatDetector) getState() liveness {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.state
+}
+
+// heartbeatRoutine checks the heartbeats of all slaves. Dead slaves are
+// closed, gc_routine then removes them and reassigns their tasks.
+func (m *Master) heartbeatRoutine() {
+	end := false
+	for !end {
+		select {
+		case <-m.close:
+			end = true
+		case <-time.After(constants.HeartbeatCheckInterval):
+			m.checkHeartbeats(time.Now())
+		}
+	}
+	m.closeWait.Done()
+}
+
+func (m *Master) checkHeartbeats(now time.Time) {
+	m.slavePool.mtx.RLock()
+	slaves := append([]*Slave(nil), m.slavePool.slaves...)
+	m.slavePool.mtx.RUnlock()
+
+	for _, s := range slaves {
+		from, to := s.heartbeat.check(now, m.SuspectPhi, m.DeadPhi)
+		if from == to {
+			continue
+		}
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Slave is "+to.String(), "slave_ip", s.ip,
+			"slave_id", strconv.Itoa(int(s.id)), "was", from.String(),
+			"phi", strconv.FormatFloat(s.heartbeat.phi(now), 'f', 2, 64)))
+		switch to {
+		case slaveAlive:
+			s.notifyCapacity()
+		case slaveDead:
+			s.stop()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+)
+
+func TestSlaveInitDSStartsDetector(t *testing.T) {
+	s := &Slave{}
+	s.InitDS()
+	// A second start resets the detector.
+	s.heartbeat.start(time.Now())
+
+	if got := s.heartbeat.getState(); got != slaveAlive {
+		t.Fatalf("state after InitDS = %v, want alive", got)
+	}
+	if phi := s.heartbeat.phi(time.Now()); phi > constants.HeartbeatSuspectPhi {
+		t.Fatalf("phi right after InitDS = %v, want below %v", phi, constants.HeartbeatSuspectPhi)
+	}
+}
+
+func TestHeartbeatDetectorStates(t *testing.T) {
+	var d heartbeatDetector
+	now := time.Now()
+	d.start(now)
+	for i := 0; i < 20; i++ {
+		now = now.Add(constants.HeartbeatInterval)
+		d.heartbeat(now)
+	}
+	if _, to := d.check(now.Add(constants.HeartbeatInterval), constants.HeartbeatSuspectPhi, constants.HeartbeatDeadPhi); to != slaveAlive {
+		t.Fatalf("state with regular heartbeats = %v, want alive", to)
+	}
+
+	from, to := d.check(now.Add(time.Minute), constants.HeartbeatSuspectPhi, constants.HeartbeatDeadPhi)
+	if from != slaveAlive || to != slaveDead {
+		t.Fatalf("transition after a minute of silence = %v -> %v, want alive -> dead", from, to)
+	}
+	// Dead is final.
+	d.heartbeat(now.Add(time.Minute))
+	if _, to := d.check(now.Add(time.Minute), constants.HeartbeatSuspectPhi, constants.HeartbeatDeadPhi); to != slaveDead {
+		t.Fatalf("state after a late heartbeat = %v, want dead", to)
+	}
+}
@@ -0,0 +1,100 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/logger"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+// newTestMaster returns a master with its data structures but no
+// goroutines or network.
+func newTestMaster(t *testing.T) *Master {
+	m := &Master{Logger: logger.NewLogger("test")}
+	m.initDS()
+	GlobalTasksMtx.Lock()
+	GlobalTasks = make(map[int]MasterTask)
+	tenantLoads = make(map[string]uint64)
+	GlobalTasksMtx.Unlock()
+	return m
+}
+
+// addTestSlave puts a slave in the pool of the master without connecting to
+// it. Packets to the slave are dropped.
+func addTestSlave(m *Master, id uint16, slaveID string) *Slave {
+	s, _ := addRecordingTestSlave(m, id, slaveID, 0)
+	return s
+}
+
+// addRecordingTestSlave is like addTestSlave, but the first n packets to
+// the slave are kept in the returned channel.
+func addRecordingTestSlave(m *Master, id uint16, slaveID string, n int) (*Slave, <-chan packets.PacketTransmit) {
+	s := &Slave{
+		ip:           "10.0.0.1",
+		id:           id,
+		slaveID:      slaveID,
+		Logger:       m.Logger,
+		maxLoad:      1000,
+		rejectChan:   m.taskRejections,
+		capacityChan: m.dispatchSignal,
+	}
+	s.InitDS()
+	s.setCapabilities(tasks.Capabilities(nil))
+	m.slavePool.mtx.Lock()
+	m.slavePool.slaves = append(m.slavePool.slaves, s)
+	m.slavePool.mtx.Unlock()
+	sent := make(chan packets.PacketTransmit, n)
+	record := func(pt packets.PacketTransmit) {
+		select {
+		case sent <- pt:
+		default:
+		}
+	}
+	go func() {
+		for {
+			select {
+			case pt := <-s.sendChan:
+				record(pt)
+			case w := <-s.writeChan:
+				record(w.pt)
+				w.done <- nil
+			case <-s.close:
+				return
+			}
+		}
+	}()
+	return s, sent
+}
+
+// assignTestTask creates a fibonacci task and records it as sent to the slave.
+func assignTestTask(m *Master, s *Slave) int {
+	task := &packets.TaskPacket{TaskTypeID: tasks.FibonacciTaskType, N: 10, Close: make(chan struct{})}
+	t := m.createTask(task, taskOptions{Load: 10})
+	t.AssignedTo = s
+	t.IsAssigned = true
+	updateTaskAssignment(t)
+	s.addInFlight(t.TaskId, t.Load, task.TaskTypeID)
+	setTaskStatus(t.TaskId, packets.Assigned)
+	setTaskStatus(t.TaskId, packets.Running)
+	return t.TaskId
+}
+
+func getTestTask(t *testing.T, id int) MasterTask {
+	GlobalTasksMtx.RLock()
+	defer GlobalTasksMtx.RUnlock()
+	task, ok := GlobalTasks[id]
+	if !ok {
+		t.Fatalf("task %d is not in GlobalTasks", id)
+	}
+	return task
+}
+
+func waitClosed(t *testing.T, c <-chan struct{}) {
+	select {
+	case <-c:
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed")
+	}
+}
@@ -8,7 +8,7 @@ import (
 
 	"github.com/GoodDeeds/load-balancer/common/constants"
 	"github.com/GoodDeeds/load-balancer/common/logger"
-	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
 	"github.com/op/go-logging"
 )
 
@@ -33,8 +33,17 @@ func (m *Master) StartServer(opts *HTTPOptions) {
 	m.serverHandler.server = &http.Server{Addr: listenPortStr}
 
 	http.HandleFunc("/ok", m.serverHandler.serverOk)
-	http.HandleFunc("/fibonacii", m.serverHandler.fibonaciiHandler(m))
-	http.HandleFunc("/cprimt", m.serverHandler.cprimeHandler(m))
+	http.HandleFunc("/fibonacii", m.serverHandler.taskHandler(m, "fibonacci"))
+	http.HandleFunc("/cprimt", m.serverHandler.taskHandler(m, "count_primes"))
+	http.HandleFunc("/tasks", m.serverHandler.tasksHandler)
+	http.HandleFunc("/tasks/", m.serverHandler.taskHandlerByID)
+	http.HandleFunc("/tenants", m.serverHandler.tenantsHandler)
+	http.HandleFunc("/batches", m.serverHandler.batchHandler)
+	http.HandleFunc("/stats/latency", m.serverHandler.latencyStatsHandler)
+	http.HandleFunc("/admin/algorithm", m.serverHandler.algorithmHandler)
+	http.HandleFunc("/admin/slaves", m.serverHandler.slavesHandler)
+	http.HandleFunc("/admin/weights", m.serverHandler.weightsHandler)
+	http.HandleFunc("/admin/slaves/drain", m.serverHandler.drainHandler)
 
 	m.Logger.Info(logger.FormatLogMessage("msg", "Starting the server"))
 
@@ -58,83 +67,61 @@ func (h *Handler) serverOk(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "Server is running")
 }
 
-func (h *Handler) fibonaciiHandler(m *Master) func(w http.ResponseWriter, r *http.Request) {
+// taskHandler returns a handler which runs a task of the given task type
+// with the arguments taken from the url query.
+// The optional parameter deadline_ms sets the deadline of the task.
+func (h *Handler) taskHandler(m *Master, taskType string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		n, ok := r.URL.Query()["n"]
-		if !ok || len(n) == 0 {
-			w.WriteHeader(400)
-			fmt.Fprint(w, "Needs parameter n")
-			return
-		}
-		nInt, err := strconv.Atoi(n[0])
-		if err != nil {
-			w.WriteHeader(400)
-			fmt.Fprint(w, "Parameters are improper")
-			return
-		}
-
-		t := packets.TaskPacket{
-			TaskTypeID: packets.FibonacciTaskType,
-			N:          nInt,
-			Close:      make(chan struct{}),
-		}
-		err = m.assignNewTask(&t, uint64(nInt))
-		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprint(w, "Task lost")
-		} else {
-			select {
-			case <-t.Close:
-				fmt.Fprint(w, t.Result)
-			case <-time.After(2 * time.Second):
-				select {
-				case <-t.Close:
-				default:
-					close(t.Close)
+		deadline := time.Now().Add(constants.DefaultTaskDeadline)
+		args := make(map[string]string)
+		for k, v := range r.URL.Query() {
+			if len(v) == 0 {
+				continue
+			}
+			if k == "deadline_ms" {
+				ms, err := strconv.Atoi(v[0])
+				if err != nil || ms <= 0 || int64(ms) > maxDurationMs {
+					w.WriteHeader(400)
+					fmt.Fprint(w, "Invalid deadline_ms")
+					return
 				}
-				w.WriteHeader(500)
-				fmt.Fprint(w, "Task lost")
+				deadline = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				continue
 			}
+			args[k] = v[0]
 		}
-	}
-}
 
-func (h *Handler) cprimeHandler(m *Master) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		n, ok := r.URL.Query()["n"]
-		if !ok || len(n) == 0 {
-			w.WriteHeader(400)
-			fmt.Fprint(w, "Needs parameter n")
-			return
-		}
-		nInt, err := strconv.Atoi(n[0])
+		t, err := tasks.NewTask(taskType, args)
 		if err != nil {
 			w.WriteHeader(400)
-			fmt.Fprint(w, "Parameters are improper")
+			fmt.Fprint(w, err.Error())
 			return
 		}
 
-		t := packets.TaskPacket{
-			TaskTypeID: packets.CountPrimesTaskType,
-			N:          nInt,
-			Close:      make(chan struct{}),
-		}
-		err = m.assignNewTask(&t, uint64(nInt))
-		if err != nil {
+		id, err := m.assignNewTask(t, taskOptions{Deadline: deadline})
+		if err == ErrQueueFull || err == ErrNoCapableSlave {
+			setRetryAfter(w)
+			w.WriteHeader(503)
+			fmt.Fprint(w, err.Error())
+		} else if err != nil {
 			w.WriteHeader(500)
 			fmt.Fprint(w, "Task lost")
 		} else {
 			select {
 			case <-t.Close:
-				fmt.Fprint(w, t.Result)
-			case <-time.After(2 * time.Second):
-				select {
-				case <-t.Close:
-				default:
-					close(t.Close)
+				if v, ok := getTaskView(id); ok && v.Error != "" {
+					w.WriteHeader(500)
+					fmt.Fprint(w, v.Error)
+					return
 				}
+				fmt.Fprint(w, t.Result)
+			case <-time.After(time.Until(deadline)):
+				h.m.timeoutTask(id)
 				w.WriteHeader(500)
-				fmt.Fprint(w, "Task lost")
+				fmt.Fprint(w, "Task deadline exceeded")
+			case <-r.Context().Done():
+				// Client has gone away.
+				h.m.cancelTask(id)
 			}
 		}
 	}
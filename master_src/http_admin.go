@@ -0,0 +1,261 @@
+package master
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/logger"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+type algorithmView struct {
+	Current   string                 `json:"current"`
+	Available []string               `json:"available"`
+	State     map[string]interface{} `json:"state,omitempty"`
+}
+
+type algorithmChange struct {
+	Algorithm string `json:"algorithm"`
+}
+
+func (h *Handler) getAlgorithmView() algorithmView {
+	algo, lb := h.m.getLoadBalancer()
+	v := algorithmView{
+		Current:   algo,
+		Available: Algorithms(),
+	}
+	if st, ok := lb.(LoadBalancerState); ok {
+		v.State = st.State()
+	}
+	return v
+}
+
+// algorithmHandler serves /admin/algorithm.
+// GET shows the current algorithm and its state, PUT switches to
+// the algorithm in the body. Tasks already sent to slaves stay there.
+func (h *Handler) algorithmHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.getAlgorithmView())
+
+	case http.MethodPut:
+		var change algorithmChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorView{"Invalid body: " + err.Error()})
+			return
+		}
+		lb, err := NewLoadBalancer(change.Algorithm)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorView{err.Error() + ": " + change.Algorithm})
+			return
+		}
+		old, _ := h.m.getLoadBalancer()
+		h.m.setLoadBalancer(change.Algorithm, lb)
+		h.m.Logger.Info(logger.FormatLogMessage("msg", "Switched algorithm", "from", old, "to", change.Algorithm))
+		writeJSON(w, http.StatusOK, h.getAlgorithmView())
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+	}
+}
+
+type weightsView struct {
+	Weights map[string]int `json:"weights"`
+}
+
+// weightsHandler serves /admin/weights.
+// GET shows the weights of slaves set by the operator, PUT replaces them
+// with the ones in the body, keyed by slave id, "ip:id" or "ip".
+func (h *Handler) weightsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, weightsView{h.m.getSlaveWeights()})
+
+	case http.MethodPut:
+		var change weightsView
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorView{"Invalid body: " + err.Error()})
+			return
+		}
+		for key, weight := range change.Weights {
+			if weight < 0 {
+				writeJSON(w, http.StatusBadRequest, errorView{"Invalid weight for " + key + ": " + strconv.Itoa(weight)})
+				return
+			}
+		}
+		if change.Weights == nil {
+			change.Weights = make(map[string]int)
+		}
+		h.m.setSlaveWeights(change.Weights)
+		h.m.Logger.Info(logger.FormatLogMessage("msg", "Changed slave weights", "slaves", strconv.Itoa(len(change.Weights))))
+		writeJSON(w, http.StatusOK, weightsView{h.m.getSlaveWeights()})
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+	}
+}
+
+type capabilityView struct {
+	Type          string `json:"type"`
+	Version       int    `json:"version"`
+	MaxConcurrent int    `json:"max_concurrent"`
+}
+
+type slaveView struct {
+	Slave         string            `json:"slave"`
+	SlaveID       string            `json:"slave_id"`
+	Labels        map[string]string `json:"labels"`
+	Capabilities  []capabilityView  `json:"capabilities"`
+	ReportedLoad  uint64            `json:"reported_load"`
+	EffectiveLoad uint64            `json:"effective_load"`
+	MaxLoad       uint64            `json:"max_load"`
+	InFlight      int               `json:"in_flight"`
+	LoadStale     bool              `json:"load_stale"`
+	Breaker       string            `json:"breaker"`
+	Liveness      string            `json:"liveness"`
+	Phi           float64           `json:"phi"`
+	Draining      bool              `json:"draining"`
+}
+
+func getSlaveView(s *Slave) slaveView {
+	s.mtx.RLock()
+	v := slaveView{
+		Slave:        s.ip + ":" + strconv.Itoa(int(s.id)),
+		SlaveID:      s.slaveID,
+		Labels:       copyLabels(s.labels),
+		Capabilities: []capabilityView{},
+		ReportedLoad: s.currentLoad,
+		MaxLoad:      s.maxLoad,
+		InFlight:     len(s.inFlight),
+		LoadStale:    s.loadStale,
+		Draining:     s.draining,
+	}
+	s.mtx.RUnlock()
+	v.EffectiveLoad = s.effectiveLoad()
+	v.Breaker = s.breaker.getState().String()
+	v.Liveness = s.heartbeat.getState().String()
+	v.Phi = s.heartbeat.phi(time.Now())
+	for _, c := range s.capabilities {
+		name := strconv.Itoa(int(c.TaskType))
+		if def, err := tasks.Lookup(c.TaskType); err == nil {
+			name = def.Name
+		}
+		v.Capabilities = append(v.Capabilities, capabilityView{name, c.Version, c.MaxConcurrent})
+	}
+	sort.Slice(v.Capabilities, func(i, j int) bool { return v.Capabilities[i].Type < v.Capabilities[j].Type })
+	return v
+}
+
+// slavesHandler serves GET /admin/slaves, the state of every slave in the pool.
+func (h *Handler) slavesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+		return
+	}
+
+	h.m.slavePool.mtx.RLock()
+	slaves := append([]*Slave(nil), h.m.slavePool.slaves...)
+	h.m.slavePool.mtx.RUnlock()
+
+	views := make([]slaveView, 0, len(slaves))
+	for _, s := range slaves {
+		views = append(views, getSlaveView(s))
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// drainSubmission is the body of POST /admin/slaves/drain.
+type drainSubmission struct {
+	// Slave is "ip:id" as shown by /admin/slaves.
+	Slave string `json:"slave"`
+	// TimeoutMs is how long to wait for the tasks of the slave before
+	// disconnecting it. constants.DrainTimeout is used if 0.
+	TimeoutMs int64 `json:"timeout_ms"`
+}
+
+type drainView struct {
+	Slave    string     `json:"slave"`
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Deadline time.Time  `json:"deadline"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Tasks in flight on the slave when the drain started, and now.
+	InFlightAtStart int `json:"in_flight_at_start"`
+	InFlight        int `json:"in_flight"`
+}
+
+func (h *Handler) getDrainView(r *drainRecord) drainView {
+	h.m.drains.mtx.Lock()
+	v := drainView{
+		Slave:           r.key,
+		State:           r.state,
+		Started:         r.started,
+		Deadline:        r.deadline,
+		InFlightAtStart: r.inFlightAtStart,
+	}
+	if !r.finished.IsZero() {
+		finished := r.finished
+		v.Finished = &finished
+	}
+	h.m.drains.mtx.Unlock()
+	v.InFlight = r.slave.inFlightCount()
+	return v
+}
+
+// drainHandler serves /admin/slaves/drain.
+// POST starts draining the slave in the body: it gets no new tasks and is
+// disconnected once its tasks finish or the timeout passes, tasks left are
+// reassigned. GET shows the progress of all drains.
+func (h *Handler) drainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.m.drains.mtx.Lock()
+		records := make([]*drainRecord, 0, len(h.m.drains.records))
+		for _, rec := range h.m.drains.records {
+			records = append(records, rec)
+		}
+		h.m.drains.mtx.Unlock()
+
+		views := make([]drainView, 0, len(records))
+		for _, rec := range records {
+			views = append(views, h.getDrainView(rec))
+		}
+		sort.Slice(views, func(i, j int) bool { return views[i].Slave < views[j].Slave })
+		writeJSON(w, http.StatusOK, views)
+
+	case http.MethodPost:
+		var sub drainSubmission
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorView{"Invalid body: " + err.Error()})
+			return
+		}
+		if sub.TimeoutMs < 0 {
+			writeJSON(w, http.StatusBadRequest, errorView{"Invalid timeout_ms"})
+			return
+		}
+		s := h.m.findSlave(sub.Slave)
+		if s == nil {
+			writeJSON(w, http.StatusNotFound, errorView{ErrUnknownSlave.Error() + ": " + sub.Slave})
+			return
+		}
+		rec, err := h.m.drainSlave(s, time.Duration(sub.TimeoutMs)*time.Millisecond)
+		if err == ErrMasterClosing {
+			writeJSON(w, http.StatusServiceUnavailable, errorView{err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusConflict, errorView{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, h.getDrainView(rec))
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+	}
+}
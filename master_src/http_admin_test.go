@@ -0,0 +1,33 @@
+package master
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWeightsCanBeChangedAtRuntime(t *testing.T) {
+	m := newTestMaster(t)
+	s := addTestSlave(m, 1, "a")
+	h := &Handler{m: m}
+
+	w := httptest.NewRecorder()
+	h.weightsHandler(w, httptest.NewRequest("PUT", "/admin/weights", strings.NewReader(`{"weights": {"a": 5, "10.0.0.1": 2}}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT /admin/weights = %d %s, want 200", w.Code, w.Body.String())
+	}
+	// The slave id goes before the address.
+	if got := m.slaveWeight(s); got != 5 {
+		t.Fatalf("weight of slave = %d, want 5", got)
+	}
+
+	w = httptest.NewRecorder()
+	h.weightsHandler(w, httptest.NewRequest("PUT", "/admin/weights", strings.NewReader(`{"weights": {"a": -1}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("PUT of a negative weight = %d, want 400", w.Code)
+	}
+	if got := m.slaveWeight(s); got != 5 {
+		t.Fatalf("weight after a refused change = %d, want 5", got)
+	}
+}
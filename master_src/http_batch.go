@@ -0,0 +1,271 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+// batchSubmission is the body of POST /batches. Every item is the
+// arguments of one task of the given type, the other fields apply to all items.
+type batchSubmission struct {
+	Type       string                   `json:"type"`
+	Items      []map[string]interface{} `json:"items"`
+	DeadlineMs int64                    `json:"deadline_ms"`
+	Priority   int                      `json:"priority"`
+	Tenant     string                   `json:"tenant"`
+	Class      string                   `json:"class"`
+	Selector   LabelSelector            `json:"selector"`
+	// TimeoutMs bounds the whole batch, constants.MaxBatchDuration if 0.
+	TimeoutMs int64 `json:"timeout_ms"`
+	// Format of the reply: "ndjson" (default) and "sse" stream every item
+	// as it finishes followed by the summary, "json" replies once at the end.
+	Format string `json:"format"`
+}
+
+type batchItemView struct {
+	Index int `json:"index"`
+	taskView
+}
+
+type batchSummary struct {
+	Total      int            `json:"total"`
+	Statuses   map[string]int `json:"statuses"`
+	Retries    int            `json:"retries"`
+	DurationMs int64          `json:"duration_ms"`
+}
+
+// batchItemRejected is the status of items which were never submitted.
+const batchItemRejected = "Rejected"
+
+const batchTimedOut = "Batch timed out"
+
+type batchWriter interface {
+	item(v batchItemView)
+	summary(s batchSummary)
+}
+
+type ndjsonBatchWriter struct {
+	w http.ResponseWriter
+}
+
+func (b *ndjsonBatchWriter) write(v interface{}) {
+	json.NewEncoder(b.w).Encode(v)
+	if f, ok := b.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (b *ndjsonBatchWriter) item(v batchItemView) { b.write(v) }
+func (b *ndjsonBatchWriter) summary(s batchSummary) {
+	b.write(struct {
+		Summary batchSummary `json:"summary"`
+	}{s})
+}
+
+type sseBatchWriter struct {
+	w http.ResponseWriter
+}
+
+func (b *sseBatchWriter) write(event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(b.w, "event: %s\ndata: %s\n\n", event, data)
+	if f, ok := b.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (b *sseBatchWriter) item(v batchItemView)   { b.write("item", v) }
+func (b *sseBatchWriter) summary(s batchSummary) { b.write("summary", s) }
+
+type jsonBatchWriter struct {
+	w     http.ResponseWriter
+	items []batchItemView
+}
+
+func (b *jsonBatchWriter) item(v batchItemView) { b.items = append(b.items, v) }
+func (b *jsonBatchWriter) summary(s batchSummary) {
+	writeJSON(b.w, http.StatusOK, struct {
+		Items   []batchItemView `json:"items"`
+		Summary batchSummary    `json:"summary"`
+	}{b.items, s})
+}
+
+// batchHandler serves POST /batches.
+func (h *Handler) batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+		return
+	}
+
+	var sub batchSubmission
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&sub); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{"Invalid body: " + err.Error()})
+		return
+	}
+	if len(sub.Items) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorView{"Batch has no items"})
+		return
+	}
+	class, err := ParsePriorityClass(sub.Class)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{err.Error()})
+		return
+	}
+	if _, err := tasks.LookupByName(sub.Type); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{err.Error()})
+		return
+	}
+	if sub.TimeoutMs < 0 || sub.TimeoutMs > maxDurationMs {
+		writeJSON(w, http.StatusBadRequest, errorView{"Invalid timeout"})
+		return
+	}
+	if sub.DeadlineMs < 0 || sub.DeadlineMs > maxDurationMs {
+		writeJSON(w, http.StatusBadRequest, errorView{"Invalid deadline"})
+		return
+	}
+
+	var out batchWriter
+	switch sub.Format {
+	case "", "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		out = &ndjsonBatchWriter{w}
+	case "sse":
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		out = &sseBatchWriter{w}
+	case "json":
+		out = &jsonBatchWriter{w: w}
+	default:
+		writeJSON(w, http.StatusBadRequest, errorView{"Unknown format: " + sub.Format})
+		return
+	}
+
+	start := time.Now()
+	opts := taskOptions{
+		Priority: sub.Priority,
+		Tenant:   sub.Tenant,
+		Class:    class,
+		Selector: sub.Selector,
+	}
+	if sub.DeadlineMs > 0 {
+		opts.Deadline = start.Add(time.Duration(sub.DeadlineMs) * time.Millisecond)
+	}
+
+	summary := batchSummary{
+		Total:    len(sub.Items),
+		Statuses: make(map[string]int),
+	}
+	report := func(v batchItemView) {
+		summary.Statuses[v.Status]++
+		summary.Retries += v.Attempts
+		out.item(v)
+	}
+
+	timeout := constants.MaxBatchDuration
+	if sub.TimeoutMs > 0 && time.Duration(sub.TimeoutMs)*time.Millisecond < timeout {
+		timeout = time.Duration(sub.TimeoutMs) * time.Millisecond
+	}
+	expired := time.After(timeout)
+
+	// Items are submitted as earlier ones finish, so that a big batch does
+	// not fill the pending queue. The ones which cannot be submitted are
+	// reported right away.
+	type submitted struct {
+		index  int
+		taskId int
+		task   *packets.TaskPacket
+	}
+	inFlight := make(map[int]submitted)
+	done := make(chan submitted)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	next := 0
+	for next < len(sub.Items) || len(inFlight) > 0 {
+		queueFull := false
+		for next < len(sub.Items) && len(inFlight) < constants.MaxBatchInFlight {
+			args := make(map[string]string)
+			for k, v := range sub.Items[next] {
+				args[k] = fmt.Sprint(v)
+			}
+			t, err := tasks.NewTask(sub.Type, args)
+			if err == nil {
+				var id int
+				id, err = h.m.assignNewTask(t, opts)
+				if err == ErrQueueFull {
+					// Try again once there is room.
+					queueFull = true
+					break
+				}
+				if err == nil {
+					p := submitted{next, id, t}
+					inFlight[id] = p
+					go func(p submitted) {
+						select {
+						case <-p.task.Close:
+						case <-stop:
+							return
+						}
+						select {
+						case done <- p:
+						case <-stop:
+						}
+					}(p)
+					next++
+					continue
+				}
+			}
+			report(batchItemView{Index: next, taskView: taskView{Status: batchItemRejected, Error: err.Error()}})
+			next++
+		}
+
+		// With nothing of the batch in flight, the queue is full of other
+		// tasks, so check again later.
+		var retry <-chan time.Time
+		if queueFull && len(inFlight) == 0 {
+			retry = time.After(constants.QueueFullRetryAfter)
+		}
+
+		select {
+		case p := <-done:
+			delete(inFlight, p.taskId)
+			v, ok := getTaskView(p.taskId)
+			if !ok {
+				v = taskView{ID: p.taskId, Status: packets.Invalid.String()}
+			}
+			report(batchItemView{Index: p.index, taskView: v})
+		case <-retry:
+		case <-expired:
+			for id, p := range inFlight {
+				h.m.timeoutTask(id)
+				v, ok := getTaskView(id)
+				if !ok {
+					v = taskView{ID: id, Status: packets.Invalid.String()}
+				}
+				report(batchItemView{Index: p.index, taskView: v})
+			}
+			inFlight = nil
+			for ; next < len(sub.Items); next++ {
+				report(batchItemView{Index: next, taskView: taskView{Status: batchItemRejected, Error: batchTimedOut}})
+			}
+		case <-r.Context().Done():
+			// Client has gone away, nobody wants the rest.
+			for id := range inFlight {
+				h.m.cancelTask(id)
+			}
+			return
+		}
+	}
+
+	summary.DurationMs = int64(time.Since(start) / time.Millisecond)
+	out.summary(summary)
+}
@@ -0,0 +1,53 @@
+package master
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+func TestBatchLimitsItemsInFlightAndTimesOut(t *testing.T) {
+	m := newTestMaster(t)
+	m.setLoadBalancer("least_load", &LeastLoad{})
+	// The slave never replies, so no item finishes.
+	s := addTestSlave(m, 1, "a")
+	s.maxLoad = 1 << 40
+	h := &Handler{m: m}
+
+	items := make([]string, constants.MaxBatchInFlight+50)
+	for i := range items {
+		items[i] = `{"n": 10}`
+	}
+	body := `{"type": "fibonacci", "format": "json", "timeout_ms": 100, "items": [` + strings.Join(items, ",") + `]}`
+	w := httptest.NewRecorder()
+	h.batchHandler(w, httptest.NewRequest("POST", "/batches", strings.NewReader(body)))
+
+	var reply struct {
+		Items   []batchItemView `json:"items"`
+		Summary batchSummary    `json:"summary"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Items) != len(items) {
+		t.Fatalf("items in reply = %d, want %d", len(reply.Items), len(items))
+	}
+	timedOut := packets.TimedOut.String()
+	if n := reply.Summary.Statuses[timedOut]; n != constants.MaxBatchInFlight {
+		t.Errorf("timed out items = %d, want the %d in flight", n, constants.MaxBatchInFlight)
+	}
+	if n := reply.Summary.Statuses[batchItemRejected]; n != 50 {
+		t.Errorf("rejected items = %d, want the 50 never submitted", n)
+	}
+
+	GlobalTasksMtx.RLock()
+	n := len(GlobalTasks)
+	GlobalTasksMtx.RUnlock()
+	if n != constants.MaxBatchInFlight {
+		t.Fatalf("tasks created = %d, want %d", n, constants.MaxBatchInFlight)
+	}
+}
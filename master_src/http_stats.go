@@ -0,0 +1,67 @@
+package master
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+type latencyView struct {
+	Type         string    `json:"type"`
+	Samples      uint64    `json:"samples"`
+	EWMAMs       float64   `json:"ewma_ms"`
+	PeakEWMAMs   float64   `json:"peak_ewma_ms"`
+	LastSampleMs float64   `json:"last_sample_ms"`
+	LastTime     time.Time `json:"last_time"`
+}
+
+type slaveLatencyView struct {
+	Slave string        `json:"slave"`
+	Tasks []latencyView `json:"tasks"`
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// latencyStatsHandler serves GET /stats/latency, the latency of the task
+// types run by every slave.
+func (h *Handler) latencyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+		return
+	}
+
+	h.m.slavePool.mtx.RLock()
+	slaves := append([]*Slave(nil), h.m.slavePool.slaves...)
+	h.m.slavePool.mtx.RUnlock()
+
+	views := make([]slaveLatencyView, 0, len(slaves))
+	for _, s := range slaves {
+		v := slaveLatencyView{
+			Slave: s.ip + ":" + strconv.Itoa(int(s.id)),
+			Tasks: []latencyView{},
+		}
+		for tt, l := range s.latencySnapshot() {
+			name := strconv.Itoa(int(tt))
+			if def, err := tasks.Lookup(tt); err == nil {
+				name = def.Name
+			}
+			v.Tasks = append(v.Tasks, latencyView{
+				Type:         name,
+				Samples:      l.Samples,
+				EWMAMs:       durationMs(l.EWMA),
+				PeakEWMAMs:   durationMs(l.PeakEWMA),
+				LastSampleMs: durationMs(l.LastSample),
+				LastTime:     l.LastTime,
+			})
+		}
+		sort.Slice(v.Tasks, func(i, j int) bool { return v.Tasks[i].Type < v.Tasks[j].Type })
+		views = append(views, v)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,310 @@
+package master
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+// taskSubmission is the body of POST /tasks.
+type taskSubmission struct {
+	Type string                 `json:"type"`
+	Args map[string]interface{} `json:"args"`
+	// Load is optional, it is estimated from the task type if 0.
+	Load uint64 `json:"load"`
+	// TimeoutMs is how long to wait for the result before replying
+	// with 202. The reply is sent without waiting if 0.
+	TimeoutMs int64 `json:"timeout_ms"`
+	// DeadlineMs is the time from submission within which the task
+	// must finish. No deadline if 0.
+	DeadlineMs int64 `json:"deadline_ms"`
+	// Priority orders the pending tasks of a tenant within a class.
+	Priority int    `json:"priority"`
+	Tenant   string `json:"tenant"`
+	// Class is "interactive" or "batch" (default).
+	Class string `json:"class"`
+	// AffinityKey sends tasks with the same key to the same slave
+	// when the consistent_hash algorithm is used.
+	AffinityKey string `json:"affinity_key"`
+	// Selector places the task by the labels of slaves.
+	Selector LabelSelector `json:"selector"`
+}
+
+// taskView is the JSON representation of a task.
+type taskView struct {
+	ID        int               `json:"id"`
+	Type      string            `json:"type"`
+	Status    string            `json:"status"`
+	Priority  int               `json:"priority"`
+	Tenant    string            `json:"tenant"`
+	Class     string            `json:"class"`
+	Load      uint64            `json:"load"`
+	Slave     string            `json:"slave,omitempty"`
+	Result    map[string]string `json:"result,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Attempts  int               `json:"attempts"`
+	Deadline  *time.Time        `json:"deadline,omitempty"`
+	History   []transitionView  `json:"history"`
+	StatusURL string            `json:"status_url"`
+}
+
+type transitionView struct {
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
+}
+
+type errorView struct {
+	Error string `json:"error"`
+}
+
+// maxDurationMs is the largest number of ms which fits in a time.Duration.
+const maxDurationMs = math.MaxInt64 / int64(time.Millisecond)
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func setRetryAfter(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(constants.QueueFullRetryAfter/time.Second)))
+}
+
+func taskStatusURL(id int) string {
+	return "/tasks/" + strconv.Itoa(id)
+}
+
+// getTaskView returns the view of the task from GlobalTasks.
+func getTaskView(id int) (taskView, bool) {
+	GlobalTasksMtx.RLock()
+	defer GlobalTasksMtx.RUnlock()
+	t, ok := GlobalTasks[id]
+	if !ok {
+		return taskView{}, false
+	}
+
+	v := taskView{
+		ID:        t.TaskId,
+		Status:    t.TaskStatus.String(),
+		Priority:  t.Priority,
+		Tenant:    t.Tenant,
+		Class:     t.Class.String(),
+		Load:      t.Load,
+		Error:     t.FailureReason,
+		Attempts:  t.Attempts,
+		StatusURL: taskStatusURL(t.TaskId),
+	}
+	if def, err := tasks.Lookup(t.Task.TaskTypeID); err == nil {
+		v.Type = def.Name
+	}
+	if t.AssignedTo != nil {
+		v.Slave = t.AssignedTo.ip + ":" + strconv.Itoa(int(t.AssignedTo.id))
+	}
+	if !t.Deadline.IsZero() {
+		deadline := t.Deadline
+		v.Deadline = &deadline
+	}
+	for _, tr := range t.Transitions {
+		v.History = append(v.History, transitionView{tr.Status.String(), tr.Time})
+	}
+	if len(t.Task.Output) > 0 {
+		v.Result = make(map[string]string)
+		for k, val := range t.Task.Output {
+			v.Result[k] = val
+		}
+	}
+	return v, true
+}
+
+// tasksHandler serves POST /tasks.
+func (h *Handler) tasksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+		return
+	}
+
+	var sub taskSubmission
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&sub); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{"Invalid body: " + err.Error()})
+		return
+	}
+
+	args := make(map[string]string)
+	for k, v := range sub.Args {
+		args[k] = fmt.Sprint(v)
+	}
+	t, err := tasks.NewTask(sub.Type, args)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{err.Error()})
+		return
+	}
+
+	if sub.DeadlineMs < 0 || sub.DeadlineMs > maxDurationMs {
+		writeJSON(w, http.StatusBadRequest, errorView{"Invalid deadline_ms"})
+		return
+	}
+	if sub.TimeoutMs < 0 || sub.TimeoutMs > maxDurationMs {
+		writeJSON(w, http.StatusBadRequest, errorView{"Invalid timeout_ms"})
+		return
+	}
+	// No slave could ever take a bigger load.
+	if maxLoad, ok := h.m.largestMaxLoad(); ok && sub.Load > maxLoad {
+		writeJSON(w, http.StatusBadRequest, errorView{"Invalid load, above the max load of every slave"})
+		return
+	}
+	class, err := ParsePriorityClass(sub.Class)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{err.Error()})
+		return
+	}
+	opts := taskOptions{
+		Load:        sub.Load,
+		Priority:    sub.Priority,
+		Tenant:      sub.Tenant,
+		Class:       class,
+		AffinityKey: sub.AffinityKey,
+		Selector:    sub.Selector,
+	}
+	if sub.DeadlineMs > 0 {
+		opts.Deadline = time.Now().Add(time.Duration(sub.DeadlineMs) * time.Millisecond)
+	}
+
+	id, err := h.m.assignNewTask(t, opts)
+	if err == ErrQueueFull || err == ErrNoCapableSlave {
+		setRetryAfter(w)
+		writeJSON(w, http.StatusServiceUnavailable, errorView{err.Error()})
+		return
+	} else if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{err.Error()})
+		return
+	}
+
+	if sub.TimeoutMs > 0 {
+		select {
+		case <-t.Close:
+		case <-time.After(time.Duration(sub.TimeoutMs) * time.Millisecond):
+		case <-r.Context().Done():
+			// Client has gone away while waiting for the result.
+			h.m.cancelTask(id)
+			return
+		}
+	}
+
+	v, ok := getTaskView(id)
+	if !ok {
+		writeJSON(w, http.StatusGone, errorView{"Task was deleted"})
+		return
+	}
+
+	select {
+	case <-t.Close:
+		writeJSON(w, http.StatusOK, v)
+	default:
+		w.Header().Set("Location", v.StatusURL)
+		writeJSON(w, http.StatusAccepted, v)
+	}
+}
+
+// taskHandlerByID serves GET and DELETE /tasks/{id}.
+func (h *Handler) taskHandlerByID(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/tasks/"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorView{"Invalid task id"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		v, ok := getTaskView(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, errorView{"Task not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+
+	case http.MethodDelete:
+		if _, ok := getTaskView(id); !ok {
+			writeJSON(w, http.StatusNotFound, errorView{"Task not found"})
+			return
+		}
+		if !h.m.cancelTask(id) {
+			writeJSON(w, http.StatusConflict, errorView{"Task has already finished"})
+			return
+		}
+		v, _ := getTaskView(id)
+		writeJSON(w, http.StatusOK, v)
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+	}
+}
+
+type tenantView struct {
+	Name              string         `json:"name"`
+	Weight            int            `json:"weight"`
+	MaxConcurrentLoad uint64         `json:"max_concurrent_load"`
+	RunningLoad       uint64         `json:"running_load"`
+	RunningTasks      int            `json:"running_tasks"`
+	Queued            map[string]int `json:"queued"`
+}
+
+// tenantsHandler serves GET /tenants.
+func (h *Handler) tenantsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, errorView{"Method not allowed"})
+		return
+	}
+
+	queued := h.m.pending.queued()
+	names := make(map[string]struct{})
+	for name := range h.m.Tenants {
+		names[name] = struct{}{}
+	}
+	for name := range queued {
+		names[name] = struct{}{}
+	}
+
+	running := make(map[string]int)
+	GlobalTasksMtx.RLock()
+	for _, t := range GlobalTasks {
+		if statusRank(t.TaskStatus) > statusRank(packets.Unassigned) && !isTerminalStatus(t.TaskStatus) {
+			running[t.Tenant]++
+			names[t.Tenant] = struct{}{}
+		}
+	}
+	GlobalTasksMtx.RUnlock()
+
+	views := []tenantView{}
+	for _, name := range tenantNames(names) {
+		cfg := h.m.Tenants[name]
+		v := tenantView{
+			Name:              name,
+			Weight:            cfg.Weight,
+			MaxConcurrentLoad: cfg.MaxConcurrentLoad,
+			RunningLoad:       tenantLoad(name),
+			RunningTasks:      running[name],
+			Queued:            make(map[string]int),
+		}
+		if v.Weight == 0 {
+			v.Weight = 1
+		}
+		for c, n := range queued[name] {
+			v.Queued[c.String()] = n
+		}
+		views = append(views, v)
+	}
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,74 @@
+package master
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTasksHandlerRejectsInvalidSubmissions(t *testing.T) {
+	m := newTestMaster(t)
+	m.setLoadBalancer("least_load", &LeastLoad{})
+	// Max load 1000, the slave never replies.
+	addTestSlave(m, 1, "a")
+	h := &Handler{m: m}
+
+	cases := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"valid", `{"type": "fibonacci", "args": {"n": 10}}`, http.StatusAccepted},
+		{"load within the max", `{"type": "fibonacci", "args": {"n": 10}, "load": 1000}`, http.StatusAccepted},
+		{"invalid body", `{"type": `, http.StatusBadRequest},
+		{"unknown type", `{"type": "sort", "args": {"n": 10}}`, http.StatusBadRequest},
+		{"missing n", `{"type": "fibonacci"}`, http.StatusBadRequest},
+		{"negative n", `{"type": "fibonacci", "args": {"n": -1}}`, http.StatusBadRequest},
+		{"n not a number", `{"type": "fibonacci", "args": {"n": "ten"}}`, http.StatusBadRequest},
+		{"load above every slave", `{"type": "fibonacci", "args": {"n": 10}, "load": 1001}`, http.StatusBadRequest},
+		{"huge load", `{"type": "fibonacci", "args": {"n": 10}, "load": 18446744073709551615}`, http.StatusBadRequest},
+		{"negative load", `{"type": "fibonacci", "args": {"n": 10}, "load": -1}`, http.StatusBadRequest},
+		{"negative timeout", `{"type": "fibonacci", "args": {"n": 10}, "timeout_ms": -1}`, http.StatusBadRequest},
+		{"overflowing timeout", `{"type": "fibonacci", "args": {"n": 10}, "timeout_ms": 9223372036854775807}`, http.StatusBadRequest},
+		{"negative deadline", `{"type": "fibonacci", "args": {"n": 10}, "deadline_ms": -1}`, http.StatusBadRequest},
+		{"overflowing deadline", `{"type": "fibonacci", "args": {"n": 10}, "deadline_ms": 9223372036854775807}`, http.StatusBadRequest},
+		{"unknown class", `{"type": "fibonacci", "args": {"n": 10}, "class": "urgent"}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.tasksHandler(w, httptest.NewRequest("POST", "/tasks", strings.NewReader(c.body)))
+		if w.Code != c.code {
+			t.Errorf("%s: code = %d, want %d: %s", c.name, w.Code, c.code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.tasksHandler(w, httptest.NewRequest("GET", "/tasks", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET /tasks: code = %d, Allow = %q, want %d, %q", w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed, http.MethodPost)
+	}
+}
+
+func TestTaskHandlerByIDUnknownTask(t *testing.T) {
+	m := newTestMaster(t)
+	h := &Handler{m: m}
+
+	cases := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/tasks/42", http.StatusNotFound},
+		{"DELETE", "/tasks/42", http.StatusNotFound},
+		{"GET", "/tasks/abc", http.StatusBadRequest},
+		{"PUT", "/tasks/42", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.taskHandlerByID(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code {
+			t.Errorf("%s %s: code = %d, want %d", c.method, c.path, w.Code, c.code)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package master
+
+// LabelSelector places a task by the labels of slaves.
+type LabelSelector struct {
+	// Required labels must all be on a slave for it to get the task.
+	Required map[string]string `json:"required"`
+	// Preferred labels are tried first: if a slave with all of them can
+	// take the task, the task goes to one of those slaves.
+	Preferred map[string]string `json:"preferred"`
+}
+
+func matchLabels(want, labels map[string]string) bool {
+	for k, v := range want {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows tells if the slave labels have all the required labels.
+func (ls LabelSelector) Allows(labels map[string]string) bool {
+	return matchLabels(ls.Required, labels)
+}
+
+// Prefers tells if the slave labels have all the preferred labels.
+func (ls LabelSelector) Prefers(labels map[string]string) bool {
+	return matchLabels(ls.Preferred, labels)
+}
+
+// copyLabels returns a copy of the labels, nil if there are none.
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
+
+// copy returns a selector which shares no maps with ls.
+func (ls LabelSelector) copy() LabelSelector {
+	return LabelSelector{Required: copyLabels(ls.Required), Preferred: copyLabels(ls.Preferred)}
+}
+
+func (s *Slave) setLabels(labels map[string]string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.labels = copyLabels(labels)
+	if s.labels == nil {
+		s.labels = make(map[string]string)
+	}
+}
+
+// assignPreferred runs the load balancer on the slaves with the preferred
+// labels of the task first, and on all eligible slaves if none of those
+// can take the task. This way every algorithm respects the preferences
+// before applying its own policy.
+func assignPreferred(lb LoadBalancer, t TaskInfo, slaves []SlaveInfo) (int, error) {
+	if len(t.Selector.Preferred) > 0 {
+		preferred := make([]SlaveInfo, len(slaves))
+		found := false
+		for i, s := range slaves {
+			preferred[i] = s
+			if !t.Selector.Prefers(s.Labels) {
+				preferred[i].Eligible = false
+			} else if s.Eligible {
+				found = true
+			}
+		}
+		if found {
+			if i, err := lb.Assign(t, preferred); err == nil {
+				return i, nil
+			}
+		}
+	}
+	return lb.Assign(t, slaves)
+}
@@ -0,0 +1,91 @@
+package master
+
+import (
+	"testing"
+
+	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+func TestLabelSelectorMatching(t *testing.T) {
+	labels := map[string]string{"zone": "a", "hardware": "gpu"}
+	cases := []struct {
+		name string
+		want map[string]string
+		ok   bool
+	}{
+		{"no labels wanted", nil, true},
+		{"one label", map[string]string{"zone": "a"}, true},
+		{"all labels", map[string]string{"zone": "a", "hardware": "gpu"}, true},
+		{"other value", map[string]string{"zone": "b"}, false},
+		{"missing label", map[string]string{"disk": "ssd"}, false},
+		{"one label missing", map[string]string{"zone": "a", "disk": "ssd"}, false},
+		{"empty value", map[string]string{"zone": ""}, false},
+	}
+	for _, c := range cases {
+		if got := (LabelSelector{Required: c.want}).Allows(labels); got != c.ok {
+			t.Errorf("%s: Allows = %v, want %v", c.name, got, c.ok)
+		}
+		if got := (LabelSelector{Preferred: c.want}).Prefers(labels); got != c.ok {
+			t.Errorf("%s: Prefers = %v, want %v", c.name, got, c.ok)
+		}
+	}
+	if (LabelSelector{Required: map[string]string{"zone": "a"}}).Allows(nil) {
+		t.Error("a slave without labels has the required labels")
+	}
+}
+
+func TestAssignPreferredFallsBack(t *testing.T) {
+	gpu := map[string]string{"hardware": "gpu"}
+	task := TaskInfo{Load: 10, Selector: LabelSelector{Preferred: gpu}}
+	cases := []struct {
+		name   string
+		slaves []SlaveInfo
+		want   int
+	}{
+		{"preferred slave", []SlaveInfo{
+			{ID: 1, MaxLoad: 100, Eligible: true},
+			{ID: 2, MaxLoad: 100, Eligible: true, Labels: gpu},
+		}, 1},
+		{"preferred slave is full", []SlaveInfo{
+			{ID: 1, MaxLoad: 100, Eligible: true},
+			{ID: 2, Load: 95, MaxLoad: 100, Eligible: true, Labels: gpu},
+		}, 0},
+		{"preferred slave is not eligible", []SlaveInfo{
+			{ID: 1, MaxLoad: 100, Eligible: true},
+			{ID: 2, MaxLoad: 100, Eligible: false, Labels: gpu},
+		}, 0},
+		{"no preferred slave", []SlaveInfo{
+			{ID: 1, MaxLoad: 100, Eligible: true},
+		}, 0},
+	}
+	for _, c := range cases {
+		i, err := assignPreferred(&FirstAvailable{}, task, c.slaves)
+		if err != nil || i != c.want {
+			t.Errorf("%s: assignPreferred = %d, %v, want %d, nil", c.name, i, err, c.want)
+		}
+	}
+}
+
+func TestRequiredLabelsSelectSlaves(t *testing.T) {
+	m := newTestMaster(t)
+	m.setLoadBalancer("first_available", &FirstAvailable{})
+	addTestSlave(m, 1, "a").setLabels(map[string]string{"zone": "a"})
+	b := addTestSlave(m, 2, "b")
+	b.setLabels(map[string]string{"zone": "b"})
+
+	task := &packets.TaskPacket{TaskTypeID: tasks.FibonacciTaskType, N: 10, Close: make(chan struct{})}
+	id, err := m.assignNewTask(task, taskOptions{Selector: LabelSelector{Required: map[string]string{"zone": "b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getTestTask(t, id); got.AssignedTo != b {
+		t.Fatalf("task requiring zone b went to %v, want slave b", got.AssignedTo)
+	}
+
+	task = &packets.TaskPacket{TaskTypeID: tasks.FibonacciTaskType, N: 10, Close: make(chan struct{})}
+	_, err = m.assignNewTask(task, taskOptions{Selector: LabelSelector{Required: map[string]string{"zone": "c"}}})
+	if err != ErrNoCapableSlave {
+		t.Fatalf("task requiring zone c = %v, want %v", err, ErrNoCapableSlave)
+	}
+}
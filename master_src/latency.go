@@ -0,0 +1,79 @@
+package master
+
+import (
+	"math"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+// LatencyStats has the dispatch to result latency of tasks of one type on a slave.
+type LatencyStats struct {
+	Samples uint64
+	// EWMA is the exponentially weighted moving average of the latency.
+	EWMA time.Duration
+	// PeakEWMA jumps to a sample bigger than it, and decays towards
+	// smaller samples over time. It reacts to a slave slowing down
+	// much faster than EWMA does.
+	PeakEWMA   time.Duration
+	LastSample time.Duration
+	LastTime   time.Time
+}
+
+func (l *LatencyStats) observe(d time.Duration, now time.Time) {
+	if l.Samples == 0 {
+		l.EWMA = d
+		l.PeakEWMA = d
+	} else {
+		w := constants.LatencyEWMAWeight
+		l.EWMA = time.Duration(w*float64(d) + (1-w)*float64(l.EWMA))
+
+		if d > l.PeakEWMA {
+			l.PeakEWMA = d
+		} else {
+			decay := math.Exp(-float64(now.Sub(l.LastTime)) / float64(constants.LatencyPeakDecayTime))
+			l.PeakEWMA = time.Duration(decay*float64(l.PeakEWMA) + (1-decay)*float64(d))
+		}
+	}
+	l.Samples++
+	l.LastSample = d
+	l.LastTime = now
+}
+
+// observeLatency records the latency of a task of the given type which
+// finished on the slave.
+func (s *Slave) observeLatency(taskType packets.TaskType, d time.Duration) {
+	s.latencyMtx.Lock()
+	defer s.latencyMtx.Unlock()
+	if s.latency == nil {
+		s.latency = make(map[packets.TaskType]*LatencyStats)
+	}
+	l, ok := s.latency[taskType]
+	if !ok {
+		l = &LatencyStats{}
+		s.latency[taskType] = l
+	}
+	l.observe(d, time.Now())
+}
+
+// latencySnapshot returns a copy of the latency stats of all task types on the slave.
+func (s *Slave) latencySnapshot() map[packets.TaskType]LatencyStats {
+	s.latencyMtx.Lock()
+	defer s.latencyMtx.Unlock()
+	res := make(map[packets.TaskType]LatencyStats)
+	for tt, l := range s.latency {
+		res[tt] = *l
+	}
+	return res
+}
+
+// dispatchTime returns the time at which the task was last sent to a slave.
+func (t *MasterTask) dispatchTime() (time.Time, bool) {
+	for i := len(t.Transitions) - 1; i >= 0; i-- {
+		if t.Transitions[i].Status == packets.Assigned {
+			return t.Transitions[i].Time, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -1,7 +1,6 @@
 package master
 
 import (
-	"errors"
 	"net"
 	"strconv"
 	"sync"
@@ -10,6 +9,7 @@ import (
 	"github.com/GoodDeeds/load-balancer/common/constants"
 	"github.com/GoodDeeds/load-balancer/common/logger"
 	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
 	"github.com/GoodDeeds/load-balancer/common/utility"
 	"github.com/op/go-logging"
 )
@@ -29,12 +29,53 @@ type Master struct {
 
 	unackedSlaves   map[string]struct{}
 	unackedSlaveMtx sync.RWMutex
-	loadBalancer    LoadBalancerInterface
+
+	// The load balancer can be swapped while the master runs.
+	loadBalancer    LoadBalancer
+	algorithm       string
+	loadBalancerMtx sync.RWMutex
+
+	// MaxTaskRetries is the number of times a rejected task is sent to
+	// another slave. constants.MaxTaskRetries is used if 0.
+	MaxTaskRetries int
+	taskRejections chan int
+
+	// MaxPendingTasks is the size of the queue of tasks waiting for a slave.
+	// constants.MaxPendingTasks is used if 0.
+	MaxPendingTasks int
+	pending         *pendingQueue
+	// SlaveWeights are the weights of slaves for the weighted algorithms,
+	// keyed by the slave id, "ip:id" or "ip". If not set, the weight is
+	// derived from the max load of the slave on a scale of 1 to 100.
+	// They can be changed at runtime on /admin/weights.
+	SlaveWeights map[string]int
+	weightsMtx   sync.RWMutex
+
+	// A slave is suspect, and gets no new tasks, when the phi of its
+	// heartbeats reaches SuspectPhi, and is evicted when it reaches DeadPhi.
+	// constants.HeartbeatSuspectPhi and constants.HeartbeatDeadPhi are used if 0.
+	SuspectPhi float64
+	DeadPhi    float64
+
+	drains drains
+	// Drains asked for by slaves are sent here.
+	drainRequests chan drainRequest
+	// Tasks held by slaves connecting again are sent here.
+	resumeRequests chan resumeRequest
+
+	// Tenants has the scheduling configuration per tenant.
+	// Tenants not present get the zero TenantConfig.
+	Tenants map[string]TenantConfig
+	// Signalled when a slave may have free capacity.
+	dispatchSignal chan struct{}
 
 	monitor *Monitor
 
 	close     chan struct{}
 	closeWait sync.WaitGroup
+	// closeMtx orders closing m.close with routines added to closeWait
+	// after Run.
+	closeMtx sync.Mutex
 }
 
 // task as seen by master
@@ -42,15 +83,62 @@ type MasterTask struct {
 	TaskId     int
 	Task       *packets.TaskPacket
 	Load       uint64
+	Priority   int
+	Tenant     string
+	Class      PriorityClass
 	AssignedTo *Slave
 	IsAssigned bool
 	TaskStatus packets.Status
+	// Transitions has the time at which the task moved to each status.
+	Transitions []StatusTransition
+	// Attempts is the number of times the task was retried.
+	Attempts      int
+	FailureReason string
+	// Deadline is the time by which the task must finish. Zero means no deadline.
+	Deadline time.Time
+	// AffinityKey routes tasks with the same key to the same slave
+	// with consistent_hash. The task type and args are used if empty.
+	AffinityKey string
+	Selector    LabelSelector
+}
+
+// optional settings of a new task
+type taskOptions struct {
+	// Load is estimated from the task type if 0.
+	Load     uint64
+	Priority int
+	Deadline time.Time
+	// DefaultTenant is used if empty.
+	Tenant      string
+	Class       PriorityClass
+	AffinityKey string
+	Selector    LabelSelector
 }
 
 // master constructor
 func (m *Master) initDS() {
 	m.close = make(chan struct{})
 	m.unackedSlaves = make(map[string]struct{})
+	m.taskRejections = make(chan int)
+	if m.MaxTaskRetries == 0 {
+		m.MaxTaskRetries = constants.MaxTaskRetries
+	}
+	if m.MaxPendingTasks == 0 {
+		m.MaxPendingTasks = constants.MaxPendingTasks
+	}
+	if m.SuspectPhi == 0 {
+		m.SuspectPhi = constants.HeartbeatSuspectPhi
+	}
+	if m.DeadPhi == 0 {
+		m.DeadPhi = constants.HeartbeatDeadPhi
+	}
+	m.pending = newPendingQueue(m.MaxPendingTasks, func(tenant string) int {
+		return m.Tenants[tenant].Weight
+	})
+	m.dispatchSignal = make(chan struct{}, 1)
+	m.drains.records = make(map[string]*drainRecord)
+	m.drainRequests = make(chan drainRequest)
+	m.resumeRequests = make(chan resumeRequest)
 	m.slavePool = &SlavePool{
 		Logger: m.Logger,
 	}
@@ -68,37 +156,27 @@ func (m *Master) initDS() {
 func (m *Master) Run(algo string) {
 
 	m.initDS()
-	switch algo {
-	case "first_available":
-		m.loadBalancer = &FirstAvailable{&LoadBalancerBase{slavePool: m.slavePool}}
-	case "round_robin":
-		m.loadBalancer = &RoundRobin{&LoadBalancerBase{slavePool: m.slavePool}, -1}
-	case "least_difference":
-		m.loadBalancer = &LeastDifference{&LoadBalancerBase{slavePool: m.slavePool}}
-	case "least_load":
-		m.loadBalancer = &LeastLoad{&LoadBalancerBase{slavePool: m.slavePool}}
-	default:
-		m.loadBalancer = &RoundRobin{&LoadBalancerBase{slavePool: m.slavePool}, -1}
+	lb, err := NewLoadBalancer(algo)
+	if err != nil {
+		m.Logger.Warning(logger.FormatLogMessage("msg", "Using round_robin", "algorithm", algo, "err", err.Error()))
+		algo = "round_robin"
+		lb, _ = NewLoadBalancer(algo)
 	}
+	m.setLoadBalancer(algo, lb)
 	m.updateAddress()
 	m.StartServer(&HTTPOptions{
 		Logger: m.Logger,
 	})
-	m.closeWait.Add(2)
+	m.closeWait.Add(8)
 	go m.connect()
 	go m.gc_routine()
+	go m.pollTaskStatus()
+	go m.retryRoutine()
+	go m.dispatchRoutine()
+	go m.heartbeatRoutine()
+	go m.drainRequestRoutine()
+	go m.resumeRoutine()
 	m.Logger.Info(logger.FormatLogMessage("msg", "Master running"))
-	// time.Sleep(5 * time.Second)
-	// m.Logger.Info(logger.FormatLogMessage("msg", "Starting Tasks"))
-	// for i := 0; i < 10; i++ {
-	// 	t := packets.TaskPacket{TaskTypeID: packets.CountPrimesTaskType, N: i + 1, Close: make(chan struct{})}
-	// 	fmt.Println(i)
-	// 	m.assignNewTask(&t, i+1)
-	// 	<-t.Close
-	// 	fmt.Println(t.Result)
-	// 	// time.Sleep(2 * time.Second)
-	// }
-	// m.Logger.Info(logger.FormatLogMessage("msg", "Tasks complete"))
 	<-m.close
 	m.Close()
 }
@@ -121,7 +199,7 @@ func (m *Master) SlaveExists(ip net.IP, id uint16) bool {
 
 type monitorTcpData struct {
 	n   int
-	buf [1024]byte
+	buf []byte
 }
 
 func (m *Master) StartMonitor() error {
@@ -193,24 +271,12 @@ func (m *Master) gc_routine() {
 			end = true
 		default:
 			removedSlaves := m.slavePool.gc(m.Logger)
+			removeFinishedTasks()
+			m.drains.removeFinished(time.Now())
 
 			// Reassigining tasks
 			for _, slave := range removedSlaves {
-				for _, tids := range slave.tasksUndertaken {
-					GlobalTasksMtx.RLock()
-					if packet, ok := GlobalTasks[tids]; ok {
-						GlobalTasksMtx.RUnlock()
-						select {
-						case <-packet.Task.Close:
-							GlobalTasksMtx.Lock()
-							delete(GlobalTasks, tids)
-							GlobalTasksMtx.Unlock()
-
-						default:
-							m.assignNewTask(packet.Task, 0)
-						}
-					}
-				}
+				m.reassignTasks(slave)
 			}
 		}
 		<-time.After(constants.GarbageCollectionInterval)
@@ -227,11 +293,13 @@ func (m *Master) Close() {
 	}
 
 	// Closing all work of master.
+	m.closeMtx.Lock()
 	select {
 	case <-m.close:
 	default:
 		close(m.close)
 	}
+	m.closeMtx.Unlock()
 	m.monitor.Close()
 
 	// Closing all slaves.
@@ -241,23 +309,132 @@ func (m *Master) Close() {
 }
 
 // create task, find whom to assign, and send to that slave's channel
-func (m *Master) assignNewTask(task *packets.TaskPacket, load uint64) error {
-	t := m.createTask(task, load)
-	var s *Slave
-	var err error
-	s, err = m.assignTask(t)
+// returns the id of the created task
+func (m *Master) assignNewTask(task *packets.TaskPacket, opts taskOptions) (int, error) {
+	def, err := tasks.Lookup(task.TaskTypeID)
 	if err != nil {
-		time.Sleep(1 * time.Second)
-		s, err = m.assignTask(t)
-		if err == nil {
-			return errors.New("Slave cant handle it")
+		return 0, err
+	}
+	if opts.Load == 0 {
+		opts.Load = def.Load(task)
+	}
+	// Waiting is pointless if no slave could ever run the task.
+	if !m.hasCapableSlave(&MasterTask{Task: task, Selector: opts.Selector}) {
+		return 0, ErrNoCapableSlave
+	}
+	t := m.createTask(task, opts)
+
+	// Tasks already waiting go first.
+	if m.pending.len() == 0 && m.tenantAllowed(t.Tenant, t.Load) {
+		if s, err := m.assignTask(t); err == nil {
+			m.sendTask(s, t)
+			return t.TaskId, nil
+		}
+	}
+
+	if err := m.pending.push(t); err != nil {
+		GlobalTasksMtx.Lock()
+		delete(GlobalTasks, t.TaskId)
+		GlobalTasksMtx.Unlock()
+		return 0, err
+	}
+	m.Logger.Debug(logger.FormatLogMessage("msg", "Task queued", "Task ID", strconv.Itoa(t.TaskId)))
+	return t.TaskId, nil
+}
+
+// goRoutine runs f as a routine of the master which Close waits for.
+// It returns false without running f if the master is closing.
+func (m *Master) goRoutine(f func()) bool {
+	m.closeMtx.Lock()
+	defer m.closeMtx.Unlock()
+	select {
+	case <-m.close:
+		return false
+	default:
+	}
+	m.closeWait.Add(1)
+	go func() {
+		defer m.closeWait.Done()
+		f()
+	}()
+	return true
+}
+
+// signalDispatch wakes up the dispatcher of pending tasks.
+func (m *Master) signalDispatch() {
+	select {
+	case m.dispatchSignal <- struct{}{}:
+	default:
+	}
+}
+
+// dispatchRoutine sends pending tasks to slaves whenever some slave
+// may have free capacity.
+func (m *Master) dispatchRoutine() {
+	end := false
+	for !end {
+		select {
+		case <-m.close:
+			end = true
+		case <-m.dispatchSignal:
+			m.dispatchPending()
+		case <-time.After(constants.LoadRequestInterval):
+			m.dispatchPending()
+		}
+	}
+	m.closeWait.Done()
+}
+
+// pendingKey is a tenant's queue in a priority class.
+type pendingKey struct {
+	class  PriorityClass
+	tenant string
+}
+
+// dispatchPending sends tasks from the front of the queue till no more can
+// be placed. A tenant's queue in a class whose next task cannot be placed is
+// skipped till the next dispatch, so it does not hold up the others.
+func (m *Master) dispatchPending() {
+	blocked := make(map[pendingKey]bool)
+	allowed := func(pt pendingTask) bool {
+		return !blocked[pendingKey{pt.class, pt.tenant}] && m.tenantAllowed(pt.tenant, pt.load)
+	}
+	for {
+		pt, ok := m.pending.peek(allowed)
+		if !ok {
+			return
+		}
+
+		GlobalTasksMtx.RLock()
+		t, ok := GlobalTasks[pt.taskId]
+		GlobalTasksMtx.RUnlock()
+		if !ok || isTerminalStatus(t.TaskStatus) || t.AssignedTo != nil {
+			// Cancelled or timed out while waiting, or taken back by
+			// its slave connecting again.
+			m.pending.pop(pt, false)
+			continue
 		}
+
+		s, err := m.assignTask(&t)
+		if err == ErrTaskNotPending {
+			m.pending.pop(pt, false)
+			continue
+		} else if err != nil {
+			blocked[pendingKey{pt.class, pt.tenant}] = true
+			continue
+		}
+		m.pending.pop(pt, true)
+		m.sendTask(s, &t)
 	}
+}
 
-	m.Logger.Info(logger.FormatLogMessage("msg", "Assigned Task", "Task", task.Description(), "Slave", strconv.Itoa(int(s.id))))
+// sends the task to the slave chosen for it
+func (m *Master) sendTask(s *Slave, t *MasterTask) {
+	m.Logger.Info(logger.FormatLogMessage("msg", "Assigned Task", "Task", tasks.Describe(t.Task.TaskTypeID), "Slave", strconv.Itoa(int(s.id))))
 	p := m.assignTaskPacket(t)
 	pt := packets.CreatePacketTransmit(p, packets.TaskRequest)
-	s.tasksUndertaken = append(s.tasksUndertaken, t.TaskId)
-	s.sendChan <- pt
-	return nil
+	s.addInFlight(t.TaskId, t.Load, t.Task.TaskTypeID)
+	s.breaker.dispatched()
+	// If the slave is closed meanwhile, gc_routine reassigns the task.
+	s.send(pt)
 }
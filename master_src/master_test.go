@@ -0,0 +1,73 @@
+package master
+
+import (
+	"testing"
+
+	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+// queueTestTask creates a fibonacci task of the tenant and puts it in the
+// pending queue.
+func queueTestTask(t *testing.T, m *Master, tenant string, load uint64) int {
+	task := &packets.TaskPacket{TaskTypeID: tasks.FibonacciTaskType, N: 10, Close: make(chan struct{})}
+	mt := m.createTask(task, taskOptions{Load: load, Tenant: tenant})
+	if err := m.pending.push(mt); err != nil {
+		t.Fatal(err)
+	}
+	return mt.TaskId
+}
+
+func TestDispatchPendingSkipsTasksWhichCannotBePlaced(t *testing.T) {
+	m := newTestMaster(t)
+	m.setLoadBalancer("least_load", &LeastLoad{})
+	s := addTestSlave(m, 1, "a")
+	// Too big for any slave, at the front of the queue.
+	big := queueTestTask(t, m, "a", 5000)
+	small := queueTestTask(t, m, "b", 10)
+
+	m.dispatchPending()
+
+	if got := getTestTask(t, small); got.AssignedTo != s || got.TaskStatus != packets.Assigned {
+		t.Fatalf("task behind an unplaceable one = %v on %v, want assigned", got.TaskStatus, got.AssignedTo)
+	}
+	if got := getTestTask(t, big); got.TaskStatus != packets.Unassigned {
+		t.Fatalf("unplaceable task = %v, want unassigned", got.TaskStatus)
+	}
+	if n := m.pending.len(); n != 1 {
+		t.Fatalf("pending tasks = %d, want 1", n)
+	}
+	if load := tenantLoad("b"); load != 10 {
+		t.Fatalf("running load of tenant b = %d, want 10", load)
+	}
+}
+
+func TestCancelledTaskLeavesQueue(t *testing.T) {
+	m := newTestMaster(t)
+	id := queueTestTask(t, m, DefaultTenant, 10)
+
+	if !m.cancelTask(id) {
+		t.Fatal("cancelTask of a pending task = false, want true")
+	}
+	if n := m.pending.len(); n != 0 {
+		t.Fatalf("pending tasks after cancel = %d, want 0", n)
+	}
+}
+
+func TestTenantLoadFollowsTaskStatus(t *testing.T) {
+	m := newTestMaster(t)
+	s := addTestSlave(m, 1, "a")
+	id := assignTestTask(m, s)
+	if load := tenantLoad(DefaultTenant); load != 10 {
+		t.Fatalf("load of running task = %d, want 10", load)
+	}
+	requeueTask(id)
+	if load := tenantLoad(DefaultTenant); load != 0 {
+		t.Fatalf("load after requeue = %d, want 0", load)
+	}
+	setTaskStatus(id, packets.Assigned)
+	finishTask(id, packets.Complete, "")
+	if load := tenantLoad(DefaultTenant); load != 0 {
+		t.Fatalf("load after finish = %d, want 0", load)
+	}
+}
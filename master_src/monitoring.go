@@ -2,11 +2,11 @@ package master
 
 import (
 	"errors"
-	"io"
 	"net"
 	"strconv"
 	"sync"
 
+	"github.com/GoodDeeds/load-balancer/common/constants"
 	"github.com/GoodDeeds/load-balancer/common/logger"
 	"github.com/GoodDeeds/load-balancer/common/packets"
 	"github.com/op/go-logging"
@@ -18,6 +18,7 @@ type Monitor struct {
 	reqSendPort uint16
 	acked       bool
 	conn        net.Conn
+	connWriter  *packets.FrameWriter
 	logger      *logging.Logger
 
 	close     chan struct{}
@@ -35,21 +36,22 @@ func (mo *Monitor) StartAcceptingRequests(packetChan chan<- monitorTcpData) erro
 		return err
 	}
 	mo.conn = conn
+	mo.connWriter = packets.NewFrameWriter(conn, constants.MaxFrameSize)
 
 	mo.closeWait.Add(1)
 	go func() {
+		fr := packets.NewFrameReader(mo.conn, constants.MaxFrameSize)
 		end := false
 		for !end {
 			select {
 			case <-mo.close:
 				end = true
 			default:
-				var buf [2048]byte
-				n, err := mo.conn.Read(buf[0:])
+				buf, err := fr.ReadFrame()
 				mo.logger.Info(logger.FormatLogMessage("msg", "Monitor request"))
 				if err != nil {
 					mo.logger.Error(logger.FormatLogMessage("msg", "Error in reading from TCP", "err", err.Error()))
-					if err == io.EOF {
+					if isStreamBroken(err) {
 						select {
 						case <-mo.close:
 						default:
@@ -61,11 +63,9 @@ func (mo *Monitor) StartAcceptingRequests(packetChan chan<- monitorTcpData) erro
 					continue
 				}
 
-				var bufCopy [1024]byte
-				copy(bufCopy[:], buf[:])
 				packetChan <- monitorTcpData{
-					n:   n,
-					buf: bufCopy,
+					n:   len(buf),
+					buf: buf,
 				}
 			}
 		}
@@ -82,14 +82,7 @@ func (mo *Monitor) SendSlaveIPs(slaveIPs []string) {
 		SlaveIPs: slaveIPs,
 	}
 
-	bytes, err := packets.EncodePacket(res, packets.MonitorResponse)
-	if err != nil {
-		mo.logger.Error(logger.FormatLogMessage("msg", "Failed to encode packet",
-			"packet", packets.MonitorResponse.String(), "err", err.Error()))
-		return
-	}
-
-	_, err = mo.conn.Write(bytes)
+	err := mo.connWriter.WritePacket(res, packets.MonitorResponse)
 	mo.logger.Info(logger.FormatLogMessage("msg", "Sending slave ip"))
 	if err != nil {
 		mo.logger.Error(logger.FormatLogMessage("msg", "Failed to send packet",
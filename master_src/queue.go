@@ -0,0 +1,278 @@
+package master
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrQueueFull = errors.New("Pending task queue is full")
+
+// PriorityClass of a task. Pending tasks of a higher class are always
+// dispatched before tasks of a lower class.
+type PriorityClass int
+
+const (
+	BatchClass PriorityClass = iota
+	InteractiveClass
+	numPriorityClasses
+)
+
+func (c PriorityClass) String() string {
+	switch c {
+	case BatchClass:
+		return "batch"
+	case InteractiveClass:
+		return "interactive"
+	default:
+		return ""
+	}
+}
+
+func ParsePriorityClass(s string) (PriorityClass, error) {
+	switch s {
+	case "", "batch":
+		return BatchClass, nil
+	case "interactive":
+		return InteractiveClass, nil
+	default:
+		return BatchClass, errors.New("Unknown priority class: " + s)
+	}
+}
+
+const DefaultTenant = "default"
+
+// TenantConfig is the scheduling configuration of a tenant.
+type TenantConfig struct {
+	// Weight is the share of the tenant in weighted fair queuing. 1 if 0.
+	Weight int
+	// MaxConcurrentLoad is the max total load of the tenant's tasks running
+	// at once. No limit if 0.
+	MaxConcurrentLoad uint64
+}
+
+type pendingTask struct {
+	taskId   int
+	priority int
+	seq      uint64
+	load     uint64
+	tenant   string
+	class    PriorityClass
+}
+
+// pendingHeap orders tasks by priority (higher first), and by the
+// order of arrival for equal priority.
+type pendingHeap []pendingTask
+
+func (h pendingHeap) Len() int { return len(h) }
+func (h pendingHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h pendingHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *pendingHeap) Push(x interface{}) { *h = append(*h, x.(pendingTask)) }
+func (h *pendingHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+type tenantQueue struct {
+	tasks pendingHeap
+	// finish tag of the last task dispatched from this tenant
+	lastFinish float64
+}
+
+// classQueue does start-time weighted fair queuing across tenants:
+// the tenant whose next task has the smallest start tag is served first,
+// and a tenant's tags advance by load/weight for every task dispatched.
+type classQueue struct {
+	virtualTime float64
+	tenants     map[string]*tenantQueue
+}
+
+// pendingQueue is a bounded queue of tasks waiting for a slave.
+type pendingQueue struct {
+	mtx      sync.Mutex
+	capacity int
+	size     int
+	seq      uint64
+	classes  [numPriorityClasses]classQueue
+	weight   func(tenant string) int
+}
+
+func newPendingQueue(capacity int, weight func(tenant string) int) *pendingQueue {
+	q := &pendingQueue{
+		capacity: capacity,
+		weight:   weight,
+	}
+	for i := range q.classes {
+		q.classes[i].tenants = make(map[string]*tenantQueue)
+	}
+	return q
+}
+
+func (q *pendingQueue) push(t *MasterTask) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if q.size >= q.capacity {
+		return ErrQueueFull
+	}
+	cq := &q.classes[t.Class]
+	tq, ok := cq.tenants[t.Tenant]
+	if !ok {
+		tq = &tenantQueue{}
+		cq.tenants[t.Tenant] = tq
+	}
+	q.seq++
+	heap.Push(&tq.tasks, pendingTask{
+		taskId:   t.TaskId,
+		priority: t.Priority,
+		seq:      q.seq,
+		load:     t.Load,
+		tenant:   t.Tenant,
+		class:    t.Class,
+	})
+	q.size++
+	return nil
+}
+
+func (q *pendingQueue) startTag(cq *classQueue, tq *tenantQueue) float64 {
+	if tq.lastFinish > cq.virtualTime {
+		return tq.lastFinish
+	}
+	return cq.virtualTime
+}
+
+func (q *pendingQueue) cost(pt pendingTask) float64 {
+	w := q.weight(pt.tenant)
+	if w <= 0 {
+		w = 1
+	}
+	load := pt.load
+	if load == 0 {
+		load = 1
+	}
+	return float64(load) / float64(w)
+}
+
+// peek returns the task to be dispatched next. Tasks for which allowed
+// returns false are skipped along with the rest of their tenant's queue
+// in the class.
+func (q *pendingQueue) peek(allowed func(pt pendingTask) bool) (pendingTask, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for c := numPriorityClasses - 1; c >= 0; c-- {
+		cq := &q.classes[c]
+		var best pendingTask
+		var bestTag float64
+		found := false
+		for _, tq := range cq.tenants {
+			if len(tq.tasks) == 0 {
+				continue
+			}
+			head := tq.tasks[0]
+			if !allowed(head) {
+				continue
+			}
+			tag := q.startTag(cq, tq)
+			if !found || tag < bestTag || (tag == bestTag && head.seq < best.seq) {
+				best, bestTag, found = head, tag, true
+			}
+		}
+		if found {
+			return best, true
+		}
+	}
+	return pendingTask{}, false
+}
+
+// pop removes the task returned by peek, if it is still at the front of its tenant.
+// If dispatched is true the fair queuing tags are advanced.
+func (q *pendingQueue) pop(pt pendingTask, dispatched bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	cq := &q.classes[pt.class]
+	tq, ok := cq.tenants[pt.tenant]
+	if !ok || len(tq.tasks) == 0 || tq.tasks[0].taskId != pt.taskId {
+		return
+	}
+	heap.Pop(&tq.tasks)
+	q.size--
+	if dispatched {
+		start := q.startTag(cq, tq)
+		tq.lastFinish = start + q.cost(pt)
+		cq.virtualTime = start
+	}
+	q.removeIdle(cq, pt.tenant)
+}
+
+// remove takes the task out of the queue wherever it is, without advancing
+// the fair queuing tags. It returns false if the task was not queued.
+func (q *pendingQueue) remove(taskId int, class PriorityClass, tenant string) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	cq := &q.classes[class]
+	tq, ok := cq.tenants[tenant]
+	if !ok {
+		return false
+	}
+	for i := range tq.tasks {
+		if tq.tasks[i].taskId == taskId {
+			heap.Remove(&tq.tasks, i)
+			q.size--
+			q.removeIdle(cq, tenant)
+			return true
+		}
+	}
+	return false
+}
+
+// removeIdle forgets a tenant with no queued tasks once its tags no longer
+// matter.
+func (q *pendingQueue) removeIdle(cq *classQueue, tenant string) {
+	tq := cq.tenants[tenant]
+	if len(tq.tasks) == 0 && tq.lastFinish <= cq.virtualTime {
+		delete(cq.tenants, tenant)
+	}
+}
+
+func (q *pendingQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.size
+}
+
+// queued returns the number of pending tasks per tenant and class.
+func (q *pendingQueue) queued() map[string]map[PriorityClass]int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	res := make(map[string]map[PriorityClass]int)
+	for c := range q.classes {
+		for name, tq := range q.classes[c].tenants {
+			if len(tq.tasks) == 0 {
+				continue
+			}
+			if _, ok := res[name]; !ok {
+				res[name] = make(map[PriorityClass]int)
+			}
+			res[name][PriorityClass(c)] = len(tq.tasks)
+		}
+	}
+	return res
+}
+
+// tenantNames returns the sorted names of the tenants in the map.
+func tenantNames(m map[string]struct{}) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,152 @@
+package master
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/logger"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+type resumeRequest struct {
+	slave *Slave
+	held  []int
+	done  chan struct{}
+}
+
+// oldSessions returns the other slaves in the pool with the slave id of s,
+// which are earlier connections of a slave connecting again.
+func (sp *SlavePool) oldSessions(s *Slave) []*Slave {
+	if s.slaveID == "" {
+		return nil
+	}
+	sp.mtx.RLock()
+	defer sp.mtx.RUnlock()
+	var old []*Slave
+	for _, o := range sp.slaves {
+		if o != s && o.slaveID == s.slaveID {
+			old = append(old, o)
+		}
+	}
+	return old
+}
+
+// adoptTask assigns a task held by a slave connecting again to its new
+// connection, if the task is still assigned to an old connection of the
+// slave or is waiting to be placed after the slave was lost. It returns
+// false if the task finished, is unknown or went to another slave.
+func adoptTask(taskId int, s *Slave, old []*Slave) (MasterTask, bool) {
+	GlobalTasksMtx.Lock()
+	defer GlobalTasksMtx.Unlock()
+	t, ok := GlobalTasks[taskId]
+	if !ok || isTerminalStatus(t.TaskStatus) {
+		return t, false
+	}
+	if t.AssignedTo == nil {
+		if t.TaskStatus != packets.Unassigned {
+			return t, false
+		}
+	} else {
+		fromOld := false
+		for _, o := range old {
+			fromOld = fromOld || t.AssignedTo == o
+		}
+		if !fromOld {
+			return t, false
+		}
+		t.AssignedTo.removeInFlight(taskId)
+	}
+	t.AssignedTo = s
+	t.IsAssigned = true
+	if statusRank(t.TaskStatus) < statusRank(packets.Accepted) {
+		moveTenantLoad(t, packets.Accepted)
+		t.TaskStatus = packets.Accepted
+		t.Transitions = append(t.Transitions, StatusTransition{packets.Accepted, time.Now()})
+	}
+	GlobalTasks[taskId] = t
+	return t, true
+}
+
+// resumeSession reconciles the tasks held by a slave connecting again.
+// Held tasks which are still the slave's stay with it instead of being
+// reassigned, the others are returned to be cancelled on the slave as
+// another copy of them exists.
+func (m *Master) resumeSession(s *Slave, held []int) []int {
+	old := m.slavePool.oldSessions(s)
+	var stale []int
+	adopted := 0
+	for _, id := range held {
+		if isAssignedTo(id, s) {
+			// Sent on this connection before the resume came.
+			continue
+		}
+		t, ok := adoptTask(id, s, old)
+		if !ok {
+			stale = append(stale, id)
+			continue
+		}
+		s.addInFlight(id, t.Load, t.Task.TaskTypeID)
+		adopted++
+	}
+
+	// Tasks of the old connections which the slave no longer holds are
+	// reassigned by gc_routine once they are removed.
+	for _, o := range old {
+		o.stop()
+	}
+	if len(old) > 0 || len(held) > 0 {
+		m.Logger.Info(logger.FormatLogMessage("msg", "Slave resumed session", "slave_ip", s.ip,
+			"slave_id", s.slaveID, "old_sessions", strconv.Itoa(len(old)),
+			"adopted", strconv.Itoa(adopted), "stale", strconv.Itoa(len(stale))))
+	}
+	if adopted > 0 {
+		m.signalDispatch()
+	}
+	return stale
+}
+
+// cancelStaleTasks stops the copies of tasks which the slave should no
+// longer run. Their results are ignored since the tasks are not assigned
+// to the slave.
+func (s *Slave) cancelStaleTasks(ids []int) {
+	for _, id := range ids {
+		pt := packets.CreatePacketTransmit(packets.TaskCancelPacket{TaskId: id}, packets.TaskCancel)
+		if !s.send(pt) {
+			return
+		}
+	}
+}
+
+// resume passes the tasks held by the slave to the master and waits till
+// they are reconciled, so that results which follow on the connection find
+// their tasks assigned to this slave.
+func (s *Slave) resume(held []int) {
+	req := resumeRequest{s, held, make(chan struct{})}
+	select {
+	case s.resumeChan <- req:
+	case <-s.close:
+		return
+	}
+	select {
+	case <-req.done:
+	case <-s.close:
+	}
+}
+
+// resumeRoutine reconciles the tasks of slaves connecting again.
+func (m *Master) resumeRoutine() {
+	end := false
+	for !end {
+		select {
+		case <-m.close:
+			end = true
+		case req := <-m.resumeRequests:
+			stale := m.resumeSession(req.slave, req.held)
+			close(req.done)
+			if len(stale) > 0 {
+				go req.slave.cancelStaleTasks(stale)
+			}
+		}
+	}
+	m.closeWait.Done()
+}
@@ -0,0 +1,53 @@
+package master
+
+import (
+	"testing"
+
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+func TestResumeSessionAdoptsHeldTasks(t *testing.T) {
+	m := newTestMaster(t)
+	old := addTestSlave(m, 1, "slave-a")
+	other := addTestSlave(m, 2, "slave-b")
+	kept := assignTestTask(m, old)
+	lost := assignTestTask(m, old)
+	moved := assignTestTask(m, other)
+	done := assignTestTask(m, old)
+	finishTask(done, packets.Complete, "")
+
+	s := addTestSlave(m, 3, "slave-a")
+	stale := m.resumeSession(s, []int{kept, moved, done, 999})
+
+	if got := getTestTask(t, kept).AssignedTo; got != s {
+		t.Errorf("held task is assigned to %v, want the new session", got)
+	}
+	if got := getTestTask(t, lost).AssignedTo; got != old {
+		t.Errorf("task not held is assigned to %v, want the old session till gc", got)
+	}
+	if got := getTestTask(t, moved).AssignedTo; got != other {
+		t.Errorf("task of another slave is assigned to %v, want it unchanged", got)
+	}
+	want := map[int]bool{moved: true, done: true, 999: true}
+	if len(stale) != len(want) {
+		t.Fatalf("stale = %v, want %v", stale, want)
+	}
+	for _, id := range stale {
+		if !want[id] {
+			t.Errorf("task %d is stale, want only %v", id, want)
+		}
+	}
+	waitClosed(t, old.close)
+	if s.inFlightCount() != 1 {
+		t.Errorf("in flight on the new session = %d, want 1", s.inFlightCount())
+	}
+
+	// gc reassigns only what the slave no longer holds.
+	m.reassignTasks(old)
+	if got := getTestTask(t, lost); got.AssignedTo != nil || got.TaskStatus != packets.Unassigned {
+		t.Errorf("lost task = %v %v, want unassigned", got.AssignedTo, got.TaskStatus)
+	}
+	if got := getTestTask(t, kept).AssignedTo; got != s {
+		t.Errorf("held task moved to %v by gc, want the new session", got)
+	}
+}
@@ -0,0 +1,589 @@
+package master
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+/*
+	The simulator runs a LoadBalancer against virtual slaves, in virtual time,
+	without any network. Given the same SimConfig it always gives the same
+	SimReport, as long as the LoadBalancer itself is deterministic.
+
+	It models what the master sees of a real pool: slaves report their load
+	every ReportInterval (staggered across slaves), the master corrects it
+	with the tasks in flight, slaves reject tasks which do not fit, rejected
+	tasks are retried with backoff, and tasks which cannot be placed wait in
+	a FIFO queue.
+*/
+
+// SimSlave describes a group of identical virtual slaves.
+type SimSlave struct {
+	Name string `json:"name"`
+	// Count of slaves in the group, 1 if 0.
+	Count   int    `json:"count"`
+	MaxLoad uint64 `json:"max_load"`
+	// Speed is the load the slave gets through in a second. The run time of
+	// a task is exponentially distributed with mean load/speed.
+	Speed float64 `json:"speed"`
+	// FailureRate is the probability that a task fails on the slave.
+	FailureRate float64           `json:"failure_rate"`
+	Weight      int               `json:"weight"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// SimTask is a task of the workload trace.
+type SimTask struct {
+	// AtMs is the arrival time of the task from the start, in ms.
+	AtMs        int64         `json:"at_ms"`
+	Type        string        `json:"type"`
+	Load        uint64        `json:"load"`
+	AffinityKey string        `json:"affinity_key"`
+	Selector    LabelSelector `json:"selector"`
+}
+
+// SimWorkload generates a trace with Poisson arrivals.
+type SimWorkload struct {
+	Tasks      int     `json:"tasks"`
+	RatePerSec float64 `json:"rate_per_sec"`
+	// Loads are uniform in [MinLoad, MaxLoad].
+	MinLoad uint64   `json:"min_load"`
+	MaxLoad uint64   `json:"max_load"`
+	Types   []string `json:"types"`
+	// Keys is the number of distinct affinity keys, no keys if 0.
+	Keys int `json:"keys"`
+}
+
+type SimConfig struct {
+	Seed   int64      `json:"seed"`
+	Slaves []SimSlave `json:"slaves"`
+	// Trace is used if not empty, otherwise it is generated from Workload.
+	Trace    []SimTask   `json:"trace"`
+	Workload SimWorkload `json:"workload"`
+	// ReportIntervalMs is constants.LoadRequestInterval if 0.
+	ReportIntervalMs int64 `json:"report_interval_ms"`
+	// MaxRetries is constants.MaxTaskRetries if 0.
+	MaxRetries int `json:"max_retries"`
+	// NoInFlight makes the balancer see only the reported loads, as the
+	// master did before it tracked the tasks in flight.
+	NoInFlight bool `json:"no_in_flight"`
+}
+
+type SimSlaveReport struct {
+	Name       string  `json:"name"`
+	Tasks      int     `json:"tasks"`
+	Rejections int     `json:"rejections"`
+	Failed     int     `json:"failed"`
+	MeanUtil   float64 `json:"mean_utilisation"`
+}
+
+type SimReport struct {
+	Algorithm  string `json:"algorithm"`
+	Tasks      int    `json:"tasks"`
+	Completed  int    `json:"completed"`
+	Failed     int    `json:"failed"`
+	Rejections int    `json:"rejections"`
+	// GaveUp is the number of tasks dropped after MaxRetries rejections.
+	GaveUp int `json:"gave_up"`
+	// Unplaced is the number of tasks no slave could ever take.
+	Unplaced   int           `json:"unplaced"`
+	Duration   time.Duration `json:"duration"`
+	Throughput float64       `json:"throughput"`
+	LatencyP50 time.Duration `json:"latency_p50"`
+	LatencyP95 time.Duration `json:"latency_p95"`
+	LatencyP99 time.Duration `json:"latency_p99"`
+	LatencyMax time.Duration `json:"latency_max"`
+	// MeanQueueWait is the mean time from arrival to being accepted by a slave.
+	MeanQueueWait time.Duration `json:"mean_queue_wait"`
+	// Imbalance is the mean over time of the standard deviation of the
+	// utilisation of the slaves, and PeakImbalance of max - min utilisation.
+	Imbalance     float64          `json:"imbalance"`
+	PeakImbalance float64          `json:"peak_imbalance"`
+	Slaves        []SimSlaveReport `json:"slaves"`
+}
+
+// simEpoch is the wall clock time at the start of every simulation.
+var simEpoch = time.Unix(0, 0)
+
+// Validate tells if a trace can be generated from the workload.
+func (w SimWorkload) Validate() error {
+	if w.Tasks < 0 {
+		return errors.New("Number of tasks must not be negative")
+	}
+	if w.RatePerSec < 0 || math.IsNaN(w.RatePerSec) || math.IsInf(w.RatePerSec, 0) {
+		return errors.New("Task rate must be a positive number")
+	}
+	if w.MinLoad > w.MaxLoad {
+		return errors.New("Min load must not be above max load")
+	}
+	if w.MaxLoad-w.MinLoad >= math.MaxInt64 {
+		return errors.New("Load range is too large")
+	}
+	if w.Keys < 0 {
+		return errors.New("Number of keys must not be negative")
+	}
+	return nil
+}
+
+// Validate tells if the config can be simulated. The workload is checked
+// when the trace is generated from it.
+func (c SimConfig) Validate() error {
+	if len(c.Slaves) == 0 {
+		return errors.New("Simulation has no slaves")
+	}
+	if c.ReportIntervalMs < 0 || c.ReportIntervalMs > maxDurationMs {
+		return errors.New("Report interval must be positive")
+	}
+	if c.MaxRetries < 0 {
+		return errors.New("Max retries must not be negative")
+	}
+	for _, s := range c.Slaves {
+		if s.Count < 0 {
+			return errors.New("Slave count must not be negative: " + s.Name)
+		}
+		if s.Speed <= 0 || math.IsNaN(s.Speed) || math.IsInf(s.Speed, 0) {
+			return errors.New("Slave speed must be positive: " + s.Name)
+		}
+		if !(s.FailureRate >= 0 && s.FailureRate <= 1) {
+			return errors.New("Slave failure rate must be within [0, 1]: " + s.Name)
+		}
+	}
+	for _, t := range c.Trace {
+		if t.AtMs < 0 || t.AtMs > maxDurationMs {
+			return errors.New("Task arrival time is out of range: " + strconv.FormatInt(t.AtMs, 10))
+		}
+	}
+	return nil
+}
+
+// GenerateTrace returns the trace of the workload.
+func GenerateTrace(w SimWorkload, seed int64) ([]SimTask, error) {
+	if err := w.Validate(); err != nil {
+		return nil, err
+	}
+	rng := rand.New(rand.NewSource(seed))
+	if w.RatePerSec == 0 {
+		w.RatePerSec = 1
+	}
+	if len(w.Types) == 0 {
+		w.Types = []string{"fibonacci"}
+	}
+
+	trace := make([]SimTask, w.Tasks)
+	at := 0.0
+	for i := range trace {
+		at += rng.ExpFloat64() / w.RatePerSec
+		trace[i] = SimTask{
+			AtMs: int64(at * 1000),
+			Type: w.Types[rng.Intn(len(w.Types))],
+			Load: w.MinLoad + uint64(rng.Int63n(int64(w.MaxLoad-w.MinLoad+1))),
+		}
+		if w.Keys > 0 {
+			trace[i].AffinityKey = "key-" + strconv.Itoa(rng.Intn(w.Keys))
+		}
+	}
+	return trace, nil
+}
+
+// seeder is implemented by the randomised algorithms, so that
+// simulations of them can be repeated.
+type seeder interface {
+	seed(seed int64)
+}
+
+func (p *randomPicker) seed(seed int64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.rng = rand.New(rand.NewSource(seed))
+}
+
+const (
+	simArrival = iota
+	simRetry
+	simCompletion
+	simReport
+)
+
+type simEvent struct {
+	at    time.Duration
+	seq   uint64
+	kind  int
+	task  int
+	slave int
+}
+
+type simEvents []simEvent
+
+func (e simEvents) Len() int { return len(e) }
+func (e simEvents) Less(i, j int) bool {
+	if e[i].at != e[j].at {
+		return e[i].at < e[j].at
+	}
+	return e[i].seq < e[j].seq
+}
+func (e simEvents) Swap(i, j int)       { e[i], e[j] = e[j], e[i] }
+func (e *simEvents) Push(x interface{}) { *e = append(*e, x.(simEvent)) }
+func (e *simEvents) Pop() interface{} {
+	old := *e
+	n := len(old)
+	x := old[n-1]
+	*e = old[:n-1]
+	return x
+}
+
+type simSlaveState struct {
+	cfg      SimSlave
+	name     string
+	load     uint64
+	reported uint64
+	lastRep  time.Duration
+	stale    bool
+	inFlight map[int]time.Duration
+	released uint64
+	latency  map[packets.TaskType]*LatencyStats
+
+	report  SimSlaveReport
+	utilSum float64
+}
+
+type simTaskState struct {
+	task     SimTask
+	taskType packets.TaskType
+	arrival  time.Duration
+	attempts int
+	// sentAt is the time the task was accepted by a slave.
+	sentAt time.Duration
+}
+
+type simulation struct {
+	cfg    SimConfig
+	lb     LoadBalancer
+	rng    *rand.Rand
+	now    time.Duration
+	seq    uint64
+	events simEvents
+	// number of events other than load reports in events
+	active int
+
+	slaves  []*simSlaveState
+	tasks   []simTaskState
+	queue   []int
+	pending int
+
+	latencies  []time.Duration
+	queueWait  time.Duration
+	accepted   int
+	imbalance  float64
+	peakImb    float64
+	samples    int
+	lastFinish time.Duration
+	report     SimReport
+}
+
+// Simulate runs the workload of the config through the load balancer.
+func Simulate(cfg SimConfig, lb LoadBalancer) (SimReport, error) {
+	if err := cfg.Validate(); err != nil {
+		return SimReport{}, err
+	}
+	if len(cfg.Trace) == 0 {
+		trace, err := GenerateTrace(cfg.Workload, cfg.Seed)
+		if err != nil {
+			return SimReport{}, err
+		}
+		cfg.Trace = trace
+	}
+	if cfg.ReportIntervalMs == 0 {
+		cfg.ReportIntervalMs = int64(constants.LoadRequestInterval / time.Millisecond)
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = constants.MaxTaskRetries
+	}
+	if s, ok := lb.(seeder); ok {
+		s.seed(cfg.Seed)
+	}
+
+	sim := &simulation{
+		cfg: cfg,
+		lb:  lb,
+		rng: rand.New(rand.NewSource(cfg.Seed)),
+	}
+
+	for _, group := range cfg.Slaves {
+		count := group.Count
+		if count == 0 {
+			count = 1
+		}
+		for i := 0; i < count; i++ {
+			name := group.Name
+			if count > 1 {
+				name += "-" + strconv.Itoa(i)
+			}
+			sim.slaves = append(sim.slaves, &simSlaveState{
+				cfg:      group,
+				name:     name,
+				inFlight: make(map[int]time.Duration),
+				latency:  make(map[packets.TaskType]*LatencyStats),
+				report:   SimSlaveReport{Name: name},
+			})
+		}
+	}
+
+	for i, t := range cfg.Trace {
+		def, err := tasks.LookupByName(t.Type)
+		if err != nil {
+			return SimReport{}, errors.New(err.Error() + ": " + t.Type)
+		}
+		arrival := time.Duration(t.AtMs) * time.Millisecond
+		sim.tasks = append(sim.tasks, simTaskState{task: t, taskType: def.ID, arrival: arrival})
+		sim.push(simEvent{at: arrival, kind: simArrival, task: i})
+	}
+	sim.pending = len(sim.tasks)
+
+	// Reports are staggered across the slaves, as they would be in a real pool.
+	interval := time.Duration(cfg.ReportIntervalMs) * time.Millisecond
+	for i := range sim.slaves {
+		sim.push(simEvent{at: interval * time.Duration(i) / time.Duration(len(sim.slaves)), kind: simReport, slave: i})
+	}
+
+	sim.run(interval)
+	return sim.finish(), nil
+}
+
+func (sim *simulation) push(e simEvent) {
+	if e.kind != simReport {
+		sim.active++
+	}
+	sim.seq++
+	e.seq = sim.seq
+	heap.Push(&sim.events, e)
+}
+
+func (sim *simulation) run(interval time.Duration) {
+	var lastActive time.Duration
+	for sim.pending > 0 && len(sim.events) > 0 {
+		e := heap.Pop(&sim.events).(simEvent)
+		sim.now = e.at
+		if e.kind != simReport {
+			sim.active--
+			lastActive = sim.now
+		} else if sim.active == 0 && sim.now-lastActive > interval {
+			// Every slave has reported since anything happened,
+			// the tasks left in the queue will never be placed.
+			sim.report.Unplaced = len(sim.queue)
+			return
+		}
+		switch e.kind {
+		case simArrival, simRetry:
+			sim.queue = append(sim.queue, e.task)
+			sim.dispatch()
+		case simCompletion:
+			sim.complete(e.task, e.slave)
+			sim.dispatch()
+		case simReport:
+			sim.loadReport(e.slave)
+			sim.push(simEvent{at: sim.now + interval, kind: simReport, slave: e.slave})
+			// Slaves which rejected a task may take tasks again.
+			sim.dispatch()
+		}
+	}
+}
+
+// effectiveLoad mirrors Slave.effectiveLoad in virtual time.
+func (sim *simulation) effectiveLoad(s *simSlaveState) uint64 {
+	if sim.cfg.NoInFlight {
+		return s.reported
+	}
+	load := s.reported
+	if s.released < load {
+		load -= s.released
+	} else {
+		load = 0
+	}
+	for id, sent := range s.inFlight {
+		if sent > s.lastRep {
+			load += sim.tasks[id].task.Load
+		}
+	}
+	return load
+}
+
+func (sim *simulation) snapshot(t TaskInfo) []SlaveInfo {
+	infos := make([]SlaveInfo, len(sim.slaves))
+	for i, s := range sim.slaves {
+		latency := make(map[packets.TaskType]LatencyStats)
+		for tt, l := range s.latency {
+			latency[tt] = *l
+		}
+		infos[i] = SlaveInfo{
+			ID:       uint16(i),
+			IP:       s.name,
+			Load:     sim.effectiveLoad(s),
+			MaxLoad:  s.cfg.MaxLoad,
+			Labels:   s.cfg.Labels,
+			Healthy:  !s.stale,
+			Eligible: !s.stale && t.Selector.Allows(s.cfg.Labels),
+			Weight:   s.cfg.Weight,
+			Latency:  latency,
+		}
+	}
+	return infos
+}
+
+// dispatch sends tasks from the front of the queue till a task cannot be placed.
+func (sim *simulation) dispatch() {
+	for len(sim.queue) > 0 {
+		id := sim.queue[0]
+		t := &sim.tasks[id]
+		info := TaskInfo{
+			ID:          id,
+			Type:        t.taskType,
+			Load:        t.task.Load,
+			AffinityKey: t.task.AffinityKey,
+			Selector:    t.task.Selector,
+		}
+		infos := sim.snapshot(info)
+		i, err := assignPreferred(sim.lb, info, infos)
+		if err != nil || i < 0 || i >= len(infos) || !infos[i].Eligible {
+			return
+		}
+		sim.queue = sim.queue[1:]
+
+		s := sim.slaves[i]
+		if s.load+t.task.Load > s.cfg.MaxLoad {
+			sim.reject(id, s)
+			continue
+		}
+
+		s.load += t.task.Load
+		s.inFlight[id] = sim.now
+		s.report.Tasks++
+		t.sentAt = sim.now
+		sim.queueWait += sim.now - t.arrival
+		sim.accepted++
+
+		mean := float64(t.task.Load) / s.cfg.Speed
+		runTime := time.Duration(sim.rng.ExpFloat64() * mean * float64(time.Second))
+		sim.push(simEvent{at: sim.now + runTime, kind: simCompletion, task: id, slave: i})
+	}
+}
+
+// reject handles a task the slave had no room for, like retryTask does.
+func (sim *simulation) reject(id int, s *simSlaveState) {
+	t := &sim.tasks[id]
+	s.stale = true
+	s.report.Rejections++
+	sim.report.Rejections++
+	t.attempts++
+	if t.attempts > sim.cfg.MaxRetries {
+		sim.report.GaveUp++
+		sim.pending--
+		return
+	}
+	backoff := constants.TaskRetryBackoffBaseTime * time.Duration(1<<uint(t.attempts-1))
+	sim.push(simEvent{at: sim.now + backoff, kind: simRetry, task: id})
+}
+
+func (sim *simulation) complete(id, slave int) {
+	t := &sim.tasks[id]
+	s := sim.slaves[slave]
+	s.load -= t.task.Load
+	if sent := s.inFlight[id]; sent <= s.lastRep {
+		s.released += t.task.Load
+	}
+	delete(s.inFlight, id)
+	sim.pending--
+	sim.lastFinish = sim.now
+
+	if sim.rng.Float64() < s.cfg.FailureRate {
+		s.report.Failed++
+		sim.report.Failed++
+		return
+	}
+	sim.report.Completed++
+	sim.latencies = append(sim.latencies, sim.now-t.arrival)
+
+	l, ok := s.latency[t.taskType]
+	if !ok {
+		l = &LatencyStats{}
+		s.latency[t.taskType] = l
+	}
+	l.observe(sim.now-t.sentAt, simEpoch.Add(sim.now))
+}
+
+func (sim *simulation) loadReport(slave int) {
+	s := sim.slaves[slave]
+	s.reported = s.load
+	s.lastRep = sim.now
+	s.released = 0
+	s.stale = false
+
+	// Sample the balance of the pool.
+	var sum, sumSq float64
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, o := range sim.slaves {
+		u := 0.0
+		if o.cfg.MaxLoad > 0 {
+			u = float64(o.load) / float64(o.cfg.MaxLoad)
+		}
+		o.utilSum += u
+		sum += u
+		sumSq += u * u
+		lo = math.Min(lo, u)
+		hi = math.Max(hi, u)
+	}
+	n := float64(len(sim.slaves))
+	mean := sum / n
+	sim.imbalance += math.Sqrt(math.Max(0, sumSq/n-mean*mean))
+	sim.peakImb += hi - lo
+	sim.samples++
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func (sim *simulation) finish() SimReport {
+	r := sim.report
+	r.Tasks = len(sim.tasks)
+	r.Duration = sim.lastFinish
+	if r.Duration > 0 {
+		r.Throughput = float64(r.Completed) / r.Duration.Seconds()
+	}
+
+	sort.Slice(sim.latencies, func(i, j int) bool { return sim.latencies[i] < sim.latencies[j] })
+	r.LatencyP50 = percentile(sim.latencies, 0.50)
+	r.LatencyP95 = percentile(sim.latencies, 0.95)
+	r.LatencyP99 = percentile(sim.latencies, 0.99)
+	r.LatencyMax = percentile(sim.latencies, 1)
+	if sim.accepted > 0 {
+		r.MeanQueueWait = sim.queueWait / time.Duration(sim.accepted)
+	}
+	if sim.samples > 0 {
+		r.Imbalance = sim.imbalance / float64(sim.samples)
+		r.PeakImbalance = sim.peakImb / float64(sim.samples)
+	}
+
+	for _, s := range sim.slaves {
+		if sim.samples > 0 {
+			s.report.MeanUtil = s.utilSum / float64(sim.samples)
+		}
+		r.Slaves = append(r.Slaves, s.report)
+	}
+	return r
+}
@@ -0,0 +1,155 @@
+package master
+
+import "testing"
+
+// benchConfig is a small uneven pool under a bursty workload.
+var benchConfig = SimConfig{
+	Seed: 1,
+	Slaves: []SimSlave{
+		{Name: "big", Count: 2, MaxLoad: 400, Speed: 200},
+		{Name: "medium", Count: 4, MaxLoad: 2000, Speed: 100},
+		{Name: "small", Count: 4, MaxLoad: 100, Speed: 50, FailureRate: 0.01},
+	},
+	Workload: SimWorkload{
+		Tasks:      2000,
+		RatePerSec: 40,
+		MinLoad:    5,
+		MaxLoad:    60,
+		Types:      []string{"fibonacci", "count_primes"},
+		Keys:       100,
+	},
+}
+
+func BenchmarkSimulate(b *testing.B) {
+	trace, err := GenerateTrace(benchConfig.Workload, benchConfig.Seed)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cfg := benchConfig
+	cfg.Trace = trace
+	for _, algo := range Algorithms() {
+		b.Run(algo, func(b *testing.B) {
+			var report SimReport
+			for i := 0; i < b.N; i++ {
+				lb, err := NewLoadBalancer(algo)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if report, err = Simulate(cfg, lb); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(report.Imbalance, "imbalance")
+			b.ReportMetric(float64(report.LatencyP99.Milliseconds()), "p99-ms")
+		})
+	}
+}
+
+func BenchmarkGenerateTrace(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := GenerateTrace(benchConfig.Workload, int64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestGenerateTraceRejectsInvalidWorkloads(t *testing.T) {
+	workloads := map[string]SimWorkload{
+		"min above max":  {Tasks: 10, MinLoad: 20, MaxLoad: 10},
+		"range overflow": {Tasks: 10, MinLoad: 0, MaxLoad: ^uint64(0)},
+		"negative tasks": {Tasks: -1, MinLoad: 1, MaxLoad: 2},
+		"negative rate":  {Tasks: 10, RatePerSec: -1, MinLoad: 1, MaxLoad: 2},
+	}
+	for name, w := range workloads {
+		if _, err := GenerateTrace(w, 1); err == nil {
+			t.Errorf("%s: GenerateTrace succeeded, want an error", name)
+		}
+	}
+	if _, err := GenerateTrace(SimWorkload{Tasks: 10, MinLoad: 5, MaxLoad: 5}, 1); err != nil {
+		t.Fatalf("GenerateTrace with a single load = %v, want nil", err)
+	}
+}
+
+// herdConfig is an even pool which reports its load rarely, and whose tasks
+// in flight the balancer does not see.
+var herdConfig = SimConfig{
+	Slaves: []SimSlave{{Name: "node", Count: 10, MaxLoad: 2000, Speed: 100}},
+	Workload: SimWorkload{
+		Tasks:      3000,
+		RatePerSec: 60,
+		MinLoad:    10,
+		MaxLoad:    40,
+		Types:      []string{"fibonacci"},
+	},
+	ReportIntervalMs: 2000,
+	NoInFlight:       true,
+}
+
+func TestRandomizedAlgorithmsAvoidHerding(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		cfg := herdConfig
+		cfg.Seed = seed
+		reports := make(map[string]SimReport)
+		for _, algo := range []string{"least_load", "p2c", "random"} {
+			lb, err := NewLoadBalancer(algo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reports[algo], err = Simulate(cfg, lb); err != nil {
+				t.Fatalf("seed %d, %s: %v", seed, algo, err)
+			}
+		}
+		// Between reports least_load keeps choosing the slave which
+		// reported the lowest load.
+		herd := reports["least_load"]
+		for _, algo := range []string{"p2c", "random"} {
+			r := reports[algo]
+			if r.Imbalance >= herd.Imbalance {
+				t.Errorf("seed %d: %s mean imbalance %.3f, want below least_load's %.3f", seed, algo, r.Imbalance, herd.Imbalance)
+			}
+			if r.PeakImbalance >= herd.PeakImbalance {
+				t.Errorf("seed %d: %s peak imbalance %.3f, want below least_load's %.3f", seed, algo, r.PeakImbalance, herd.PeakImbalance)
+			}
+		}
+	}
+}
+
+func TestSimulateRejectsInvalidConfigs(t *testing.T) {
+	valid := func() SimConfig {
+		return SimConfig{
+			Slaves: []SimSlave{{Name: "node", Count: 2, MaxLoad: 100, Speed: 10}},
+			Trace:  []SimTask{{AtMs: 0, Type: "fibonacci", Load: 10}},
+		}
+	}
+	configs := map[string]func(*SimConfig){
+		"no slaves":              func(c *SimConfig) { c.Slaves = nil },
+		"negative interval":      func(c *SimConfig) { c.ReportIntervalMs = -1 },
+		"overflowing interval":   func(c *SimConfig) { c.ReportIntervalMs = 1 << 62 },
+		"negative retries":       func(c *SimConfig) { c.MaxRetries = -1 },
+		"negative slave count":   func(c *SimConfig) { c.Slaves[0].Count = -1 },
+		"zero speed":             func(c *SimConfig) { c.Slaves[0].Speed = 0 },
+		"negative failure rate":  func(c *SimConfig) { c.Slaves[0].FailureRate = -0.1 },
+		"failure rate above one": func(c *SimConfig) { c.Slaves[0].FailureRate = 1.5 },
+		"negative arrival":       func(c *SimConfig) { c.Trace[0].AtMs = -1 },
+		"overflowing arrival":    func(c *SimConfig) { c.Trace[0].AtMs = 1 << 62 },
+	}
+	for name, change := range configs {
+		cfg := valid()
+		change(&cfg)
+		lb, err := NewLoadBalancer("round_robin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Simulate(cfg, lb); err == nil {
+			t.Errorf("%s: Simulate succeeded, want an error", name)
+		}
+	}
+
+	lb, err := NewLoadBalancer("round_robin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Simulate(valid(), lb); err != nil {
+		t.Fatalf("Simulate with a valid config = %v, want nil", err)
+	}
+}
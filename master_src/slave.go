@@ -1,6 +1,7 @@
 package master
 
 import (
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -10,9 +11,12 @@ import (
 	"github.com/GoodDeeds/load-balancer/common/constants"
 	"github.com/GoodDeeds/load-balancer/common/logger"
 	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
 	"github.com/op/go-logging"
 )
 
+var ErrSlaveClosed = errors.New("Slave is closed")
+
 // Slave is used to store info of slave node connected to it
 type Slave struct {
 	ip          string
@@ -24,13 +28,54 @@ type Slave struct {
 	maxLoad     uint64
 	currentLoad uint64
 
-	sendChan        chan packets.PacketTransmit
-	tasksUndertaken []int
+	// slaveID stays the same when the slave connects again.
+	slaveID string
+	// Task types advertised by the slave.
+	capabilities map[packets.TaskType]packets.Capability
+	// Labels advertised by the slave.
+	labels map[string]string
+
+	// Latency of tasks finished by the slave, per task type.
+	latency    map[packets.TaskType]*LatencyStats
+	latencyMtx sync.Mutex
+
+	sendChan chan packets.PacketTransmit
+	// Packets sent with sendSync, whose writes are reported back.
+	writeChan chan packetWrite
 
 	lastLoadTimestamp time.Time
-	mtx               sync.RWMutex
+	// lastLoadRecv is the local time at which the last load report was taken.
+	lastLoadRecv time.Time
+	// Tasks sent to the slave which have not finished, by task id.
+	inFlight map[int]inFlightTask
+	// releasedLoad is the load of in-flight tasks counted in the last
+	// load report which have finished since.
+	releasedLoad uint64
+	// loadStale is set when the slave rejects a task, the slave is not
+	// chosen for tasks until it reports its load again.
+	loadStale bool
+	// draining is set when the slave is going out of rotation.
+	draining bool
+	mtx      sync.RWMutex
+
+	breaker   circuitBreaker
+	heartbeat heartbeatDetector
+
+	// Ids of tasks rejected by the slave are sent here.
+	rejectChan chan<- int
+	// Signalled when the slave may have free capacity.
+	capacityChan chan<- struct{}
+	// Drains asked for by the slave are sent here.
+	drainChan chan<- drainRequest
+	// Tasks held by the slave when it connects are sent here.
+	resumeChan chan<- resumeRequest
+
+	// TCP connections to the slave, closed when the slave is stopped.
+	conns    []net.Conn
+	connsMtx sync.Mutex
 
 	close     chan struct{}
+	closeOnce sync.Once
 	closeWait sync.WaitGroup
 }
 
@@ -41,12 +86,139 @@ func (s *Slave) UpdateLoad(l uint64, ml uint64, ts time.Time) {
 		s.currentLoad = l
 		s.maxLoad = ml
 		s.lastLoadTimestamp = ts
+		s.lastLoadRecv = time.Now()
+		s.releasedLoad = 0
+		s.loadStale = false
+		s.notifyCapacity()
+	}
+}
+
+type inFlightTask struct {
+	load     uint64
+	taskType packets.TaskType
+	sent     time.Time
+}
+
+// addInFlight records a task sent to the slave.
+func (s *Slave) addInFlight(taskId int, load uint64, taskType packets.TaskType) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.inFlight == nil {
+		s.inFlight = make(map[int]inFlightTask)
+	}
+	s.inFlight[taskId] = inFlightTask{load, taskType, time.Now()}
+}
+
+// removeInFlight forgets a task which is no longer on the slave.
+func (s *Slave) removeInFlight(taskId int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	t, ok := s.inFlight[taskId]
+	if !ok {
+		return
+	}
+	delete(s.inFlight, taskId)
+	if !t.sent.After(s.lastLoadRecv) {
+		s.releasedLoad += t.load
+	}
+}
+
+// effectiveLoad is the last load reported by the slave, corrected by the
+// tasks sent to it and finished since that report.
+func (s *Slave) effectiveLoad() uint64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	load := s.currentLoad
+	if s.releasedLoad < load {
+		load -= s.releasedLoad
+	} else {
+		load = 0
+	}
+	for _, t := range s.inFlight {
+		if t.sent.After(s.lastLoadRecv) {
+			load += t.load
+		}
+	}
+	return load
+}
+
+// loadRecvSince tells if a load report was taken after t.
+func (s *Slave) loadRecvSince(t time.Time) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.lastLoadRecv.After(t)
+}
+
+func (s *Slave) notifyCapacity() {
+	select {
+	case s.capacityChan <- struct{}{}:
+	default:
 	}
 }
 
+func (s *Slave) markLoadStale() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.loadStale = true
+}
+
+// eligible tells if the slave can be considered for the task at all.
+// Load balancers apply their policy only on eligible slaves.
+func (s *Slave) eligible(t *MasterTask) bool {
+	s.mtx.RLock()
+	stale := s.loadStale || s.draining
+	s.mtx.RUnlock()
+	return !stale && s.heartbeat.getState() == slaveAlive && s.capable(t) &&
+		s.hasCapacity(t.Task.TaskTypeID) && s.breaker.allow()
+}
+
+// capable tells if the slave could ever run the task, whatever its load.
+func (s *Slave) capable(t *MasterTask) bool {
+	s.mtx.RLock()
+	allowed := t.Selector.Allows(s.labels)
+	s.mtx.RUnlock()
+	return allowed && s.canRun(t.Task.TaskTypeID)
+}
+
+func (s *Slave) setCapabilities(caps []packets.Capability) {
+	s.capabilities = make(map[packets.TaskType]packets.Capability)
+	for _, c := range caps {
+		s.capabilities[c.TaskType] = c
+	}
+}
+
+// canRun tells if the slave has advertised the same version of the task type as the master.
+func (s *Slave) canRun(taskType packets.TaskType) bool {
+	c, ok := s.capabilities[taskType]
+	if !ok {
+		return false
+	}
+	def, err := tasks.Lookup(taskType)
+	return err == nil && def.Version == c.Version
+}
+
+// hasCapacity tells if the slave runs fewer tasks of the type than it allows.
+func (s *Slave) hasCapacity(taskType packets.TaskType) bool {
+	max := s.capabilities[taskType].MaxConcurrent
+	if max == 0 {
+		return true
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	n := 0
+	for _, t := range s.inFlight {
+		if t.taskType == taskType {
+			n++
+		}
+	}
+	return n < max
+}
+
 func (s *Slave) InitDS() {
 	s.close = make(chan struct{})
 	s.sendChan = make(chan packets.PacketTransmit)
+	s.writeChan = make(chan packetWrite)
+	s.heartbeat.start(time.Now())
 	//	s.recvChan = make(chan struct{})
 	//	go s.sendChannelHandler()
 	//	go s.recvChannelHandler()
@@ -67,30 +239,36 @@ func (s *Slave) loadRequestHandler() {
 
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
-		close(s.close)
+		s.Logger.Error(logger.FormatLogMessage("msg", "Failed to connect to slave", "slave_ip", s.ip, "err", err.Error()))
+		s.stop()
+		s.closeWait.Done()
+		return
 	}
+	s.addConn(conn)
 
 	s.closeWait.Add(1)
 	go s.loadRecvAndUpdater(conn)
 
+	fw := packets.NewFrameWriter(conn, constants.MaxFrameSize)
+	// Every load request is a health probe, answered by the load response.
+	var probeSent time.Time
 	end := false
 	for !end {
 		select {
 		case <-s.close:
 			end = true
 		default:
-			packet := packets.LoadRequestPacket{}
-			bytes, err := packets.EncodePacket(packet, packets.LoadRequest)
-			if err != nil {
-				s.Logger.Warning(logger.FormatLogMessage("msg", "Failed to encode packet",
-					"slave_ip", s.ip, "err", err.Error()))
+			if !probeSent.IsZero() {
+				s.recordOutcome(!s.loadRecvSince(probeSent), "health probe")
 			}
 
-			_, err = conn.Write(bytes)
+			packet := packets.LoadRequestPacket{}
+			err := fw.WritePacket(packet, packets.LoadRequest)
 			if err != nil {
 				s.Logger.Warning(logger.FormatLogMessage("msg", "Failed to send LoadReq packet",
 					"slave_ip", s.ip, "err", err.Error()))
 			}
+			probeSent = time.Now()
 
 			<-time.After(constants.LoadRequestInterval)
 		}
@@ -100,32 +278,28 @@ func (s *Slave) loadRequestHandler() {
 }
 
 func (s *Slave) loadRecvAndUpdater(conn net.Conn) {
+	fr := packets.NewFrameReader(conn, constants.MaxFrameSize)
 	end := false
 	for !end {
 		select {
 		case <-s.close:
 			end = true
 		default:
-			var buf [2048]byte
 			conn.SetReadDeadline(time.Now().Add(constants.ReceiveTimeout))
-			n, err := conn.Read(buf[0:])
+			buf, err := fr.ReadFrame()
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 				continue
 			} else if err != nil {
-				if err == io.EOF {
+				if isStreamBroken(err) {
 					s.Logger.Warning(logger.FormatLogMessage("msg", "Closing a slave (load handler)", "slave_ip", s.ip,
 						"slave_id", strconv.Itoa(int(s.id))))
-					select {
-					case <-s.close:
-					default:
-						close(s.close)
-					}
+					s.stop()
 					end = true
 				}
 				continue
 			}
 
-			packetType, err := packets.GetPacketType(buf[:n])
+			packetType, err := packets.GetPacketType(buf)
 			if err != nil {
 				s.Logger.Error(logger.FormatLogMessage("err", err.Error()))
 				return
@@ -134,7 +308,7 @@ func (s *Slave) loadRecvAndUpdater(conn net.Conn) {
 			switch packetType {
 			case packets.LoadResponse:
 				var p packets.LoadResponsePacket
-				err := packets.DecodePacket(buf[:n], &p)
+				err := packets.DecodePacket(buf, &p)
 				if err != nil {
 					s.Logger.Error(logger.FormatLogMessage("msg", "Failed to decode packet",
 						"packet", packetType.String(), "err", err.Error()))
@@ -161,9 +335,12 @@ func (s *Slave) taskRequestHandler() {
 
 		connSend, err := net.Dial("tcp", address)
 		if err != nil {
-			s.Logger.Fatal(logger.FormatLogMessage("Error!", "Error!"))
-			close(s.close)
+			s.Logger.Error(logger.FormatLogMessage("msg", "Failed to connect to slave", "slave_ip", s.ip, "err", err.Error()))
+			s.stop()
+			s.closeWait.Done()
+			return
 		}
+		s.addConn(connSend)
 
 		s.closeWait.Add(1)
 		go s.sendChannelHandler(connSend)
@@ -174,9 +351,12 @@ func (s *Slave) taskRequestHandler() {
 
 		connRecv, err := net.Dial("tcp", address)
 		if err != nil {
-			s.Logger.Fatal(logger.FormatLogMessage("Error!", "Error!"))
-			close(s.close)
+			s.Logger.Error(logger.FormatLogMessage("msg", "Failed to connect to slave", "slave_ip", s.ip, "err", err.Error()))
+			s.stop()
+			s.closeWait.Done()
+			return
 		}
+		s.addConn(connRecv)
 
 		s.closeWait.Add(1)
 		go s.taskRecvAndUpdater(connRecv)
@@ -187,40 +367,39 @@ func (s *Slave) taskRequestHandler() {
 
 type tcpData struct {
 	n   int
-	buf [2048]byte
+	buf []byte
+}
+
+// isStreamBroken tells if the error leaves the TCP stream unusable.
+func isStreamBroken(err error) bool {
+	return err == io.EOF || err == packets.ErrTruncatedFrame || err == packets.ErrFrameTooLarge
 }
 
 func (s *Slave) collectIncomingRequests(conn net.Conn, packetChan chan<- tcpData) {
+	fr := packets.NewFrameReader(conn, constants.MaxFrameSize)
 	end := false
 	for !end {
 		select {
 		case <-s.close:
 			end = true
 		default:
-			var buf [2048]byte
 			conn.SetReadDeadline(time.Now().Add(constants.SlaveReceiveTimeout))
-			n, err := conn.Read(buf[0:])
+			buf, err := fr.ReadFrame()
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 				continue
 			} else if err != nil {
 				// s.Logger.Error(logger.FormatLogMessage("msg", "Error in reading from TCP", "err", err.Error()))
-				if err == io.EOF {
+				if isStreamBroken(err) {
 					s.Logger.Error(logger.FormatLogMessage("msg", "Error in reading from TCP", "err", err.Error()))
-					select {
-					case <-s.close:
-					default:
-						close(s.close)
-					}
+					s.stop()
 					end = true
 				}
 				continue
 			}
 
-			var bufCopy [2048]byte
-			copy(bufCopy[:], buf[:])
 			packetChan <- tcpData{
-				n:   n,
-				buf: bufCopy,
+				n:   len(buf),
+				buf: buf,
 			}
 		}
 	}
@@ -282,6 +461,37 @@ func (s *Slave) taskRecvAndUpdater(conn net.Conn) {
 
 				go s.handleTaskStatusResponse(p)
 
+			case packets.Heartbeat:
+				var p packets.HeartbeatPacket
+				err := packets.DecodePacket(packet.buf[:packet.n], &p)
+				if err != nil {
+					s.Logger.Error(logger.FormatLogMessage("msg", "Failed to decode packet",
+						"packet", packetType.String(), "err", err.Error()))
+					return
+				}
+				s.heartbeat.heartbeat(time.Now())
+
+			case packets.Resume:
+				var p packets.ResumePacket
+				err := packets.DecodePacket(packet.buf[:packet.n], &p)
+				if err != nil {
+					s.Logger.Error(logger.FormatLogMessage("msg", "Failed to decode packet",
+						"packet", packetType.String(), "err", err.Error()))
+					return
+				}
+				// Not in a goroutine, results after it need the tasks reconciled.
+				s.resume(p.Tasks)
+
+			case packets.Drain:
+				var p packets.DrainPacket
+				err := packets.DecodePacket(packet.buf[:packet.n], &p)
+				if err != nil {
+					s.Logger.Error(logger.FormatLogMessage("msg", "Failed to decode packet",
+						"packet", packetType.String(), "err", err.Error()))
+					return
+				}
+				go s.requestDrain(p.Timeout)
+
 			default:
 				s.Logger.Warning(logger.FormatLogMessage("msg", "Received invalid packet"))
 			}
@@ -293,52 +503,93 @@ func (s *Slave) taskRecvAndUpdater(conn net.Conn) {
 	s.closeWait.Done()
 }
 
+// Close stops the slave. sendChan is never closed, s.close is the only
+// signal to stop sending.
 func (s *Slave) Close() {
+	s.stop()
+	s.closeWait.Wait()
+}
+
+// stop closes s.close and the connections to the slave, so the slave sees
+// the connection end. It is safe to call from any number of goroutines.
+func (s *Slave) stop() {
+	s.closeOnce.Do(func() {
+		close(s.close)
+		s.connsMtx.Lock()
+		defer s.connsMtx.Unlock()
+		for _, c := range s.conns {
+			c.Close()
+		}
+		s.conns = nil
+	})
+}
+
+// addConn keeps a connection to the slave to close it in stop.
+func (s *Slave) addConn(c net.Conn) {
+	s.connsMtx.Lock()
+	defer s.connsMtx.Unlock()
 	select {
-	case <-s.sendChan:
+	case <-s.close:
+		c.Close()
 	default:
-		close(s.sendChan)
+		s.conns = append(s.conns, c)
 	}
+}
+
+// send queues the packet for the slave. It returns false if the slave
+// is closed first.
+func (s *Slave) send(pt packets.PacketTransmit) bool {
 	select {
+	case s.sendChan <- pt:
+		return true
 	case <-s.close:
-	default:
-		close(s.close)
+		return false
+	}
+}
+
+// packetWrite is a packet sent with sendSync. The outcome of the write
+// is sent on done, which has room for it.
+type packetWrite struct {
+	pt   packets.PacketTransmit
+	done chan error
+}
+
+// sendSync sends the packet to the slave and waits till it is written.
+// Packets queued with send before are written first.
+func (s *Slave) sendSync(pt packets.PacketTransmit) error {
+	w := packetWrite{pt, make(chan error, 1)}
+	select {
+	case s.writeChan <- w:
+	case <-s.close:
+		return ErrSlaveClosed
+	}
+	select {
+	case err := <-w.done:
+		return err
+	case <-s.close:
+		return ErrSlaveClosed
 	}
-	s.closeWait.Wait()
 }
 
 func (s *Slave) sendChannelHandler(conn net.Conn) {
+	fw := packets.NewFrameWriter(conn, constants.MaxFrameSize)
+	write := func(pt packets.PacketTransmit) error {
+		err := fw.WritePacket(pt.Packet, pt.PacketType)
+		if err != nil {
+			s.Logger.Warning(logger.FormatLogMessage("msg", "Failed to send packet",
+				"slave_ip", s.ip, "err", err.Error()))
+		}
+		return err
+	}
 	end := false
 	for !end {
 		select {
 		case <-s.close:
 			end = true
-		default:
-			pt, ok := <-s.sendChan
-			if ok {
-				bytes, err := packets.EncodePacket(pt.Packet, pt.PacketType)
-				if err != nil {
-					s.Logger.Error(logger.FormatLogMessage("msg", "Error in reading packet to send", "err", err.Error()))
-					continue
-				}
-				_, err = conn.Write(bytes)
-				if err != nil {
-					s.Logger.Warning(logger.FormatLogMessage("msg", "Failed to send packet",
-						"slave_ip", s.ip, "err", err.Error()))
-				}
-			} else {
-				select {
-				case <-s.sendChan:
-				default:
-					select {
-					case <-s.close:
-					default:
-						close(s.close)
-						end = true
-					}
-				}
-			}
-
+		case pt := <-s.sendChan:
+			write(pt)
+		case w := <-s.writeChan:
+			w.done <- write(w.pt)
 		}
 	}
 	s.closeWait.Done()
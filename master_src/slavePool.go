@@ -23,8 +23,8 @@ func (sp *SlavePool) NumSlaves() int {
 
 func (sp *SlavePool) AddSlave(slave *Slave) {
 	slave.Logger = sp.Logger
-	slave.InitConnections()
 	slave.InitDS()
+	slave.InitConnections()
 	sp.mtx.Lock()
 	defer sp.mtx.Unlock()
 	sp.slaves = append(sp.slaves, slave)
@@ -0,0 +1,28 @@
+package master
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSlaveStopClosesConnections(t *testing.T) {
+	s := &Slave{}
+	s.InitDS()
+	local, remote := net.Pipe()
+	s.addConn(local)
+
+	// Stopping twice, as eviction and Close both do, must not panic.
+	s.stop()
+	s.stop()
+
+	if _, err := remote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read on the slave side after stop = %v, want EOF", err)
+	}
+
+	late, lateRemote := net.Pipe()
+	s.addConn(late)
+	if _, err := lateRemote.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read on a connection added after stop = %v, want EOF", err)
+	}
+}
@@ -2,93 +2,536 @@ package master
 
 import (
 	"errors"
+	"sort"
 	"strconv"
+	"time"
 
+	"github.com/GoodDeeds/load-balancer/common/constants"
 	"github.com/GoodDeeds/load-balancer/common/logger"
 	"github.com/GoodDeeds/load-balancer/common/packets"
 )
 
+var ErrTaskNotPending = errors.New("Task is no longer waiting for a slave")
+
 func (m *Master) assignTaskPacket(t *MasterTask) packets.TaskRequestPacket {
-	packet := packets.TaskRequestPacket{t.TaskId, *t.Task, t.Load}
+	packet := packets.TaskRequestPacket{TaskId: t.TaskId, Task: *t.Task, Load: t.Load, Deadline: t.Deadline}
 	return packet
 }
 
-// not sure if this is needed
+// tenantLoads is the total load of each tenant's tasks which are with a
+// slave. It is kept in step with GlobalTasks under GlobalTasksMtx.
+var tenantLoads = make(map[string]uint64)
+
+// isWithSlave tells if a task in the status counts towards its tenant's load.
+func isWithSlave(status packets.Status) bool {
+	return statusRank(status) > statusRank(packets.Unassigned) && !isTerminalStatus(status)
+}
+
+// moveTenantLoad updates tenantLoads for the task moving to the status.
+// GlobalTasksMtx must be held.
+func moveTenantLoad(t MasterTask, status packets.Status) {
+	was, is := isWithSlave(t.TaskStatus), isWithSlave(status)
+	switch {
+	case is && !was:
+		tenantLoads[t.Tenant] += t.Load
+	case was && !is:
+		tenantLoads[t.Tenant] -= t.Load
+		if tenantLoads[t.Tenant] == 0 {
+			delete(tenantLoads, t.Tenant)
+		}
+	}
+}
+
+// tenantLoad returns the total load of the tenant's tasks which are
+// with a slave.
+func tenantLoad(tenant string) uint64 {
+	GlobalTasksMtx.RLock()
+	defer GlobalTasksMtx.RUnlock()
+	return tenantLoads[tenant]
+}
+
+// tenantAllowed tells if a task of the tenant with the load can be dispatched
+// without going over the tenant's quota. A tenant with nothing running
+// is always allowed, so that a task bigger than the quota is not stuck.
+func (m *Master) tenantAllowed(tenant string, load uint64) bool {
+	quota := m.Tenants[tenant].MaxConcurrentLoad
+	if quota == 0 {
+		return true
+	}
+	running := tenantLoad(tenant)
+	return running == 0 || running+load <= quota
+}
+
 // requests slave to provide status of a task assigned to it
 func (m *Master) requestTaskStatusPacket(t *MasterTask) packets.TaskStatusRequestPacket {
-	packet := packets.TaskStatusRequestPacket{t.TaskId}
+	packet := packets.TaskStatusRequestPacket{TaskId: t.TaskId}
 	return packet
 }
 
-// receives task status response, does not do anything right now
+// StatusTransition records when a task moved to a status.
+type StatusTransition struct {
+	Status packets.Status
+	Time   time.Time
+}
+
+// statusRank orders the statuses of the task lifecycle. A task only moves
+// to a status of higher rank.
+func statusRank(status packets.Status) int {
+	switch status {
+	case packets.Unassigned:
+		return 0
+	case packets.Assigned:
+		return 1
+	case packets.Accepted:
+		return 2
+	case packets.Running:
+		return 3
+	case packets.Complete, packets.Failed, packets.Cancelled, packets.TimedOut:
+		return 4
+	default:
+		return -1
+	}
+}
+
+func isTerminalStatus(status packets.Status) bool {
+	return statusRank(status) == statusRank(packets.Complete)
+}
+
+// setTaskStatus moves the task in GlobalTasks to the status and records
+// the time of the transition. It returns false if the transition is not allowed.
+func setTaskStatus(taskId int, status packets.Status) bool {
+	GlobalTasksMtx.Lock()
+	defer GlobalTasksMtx.Unlock()
+	t, ok := GlobalTasks[taskId]
+	if !ok || statusRank(status) <= statusRank(t.TaskStatus) {
+		return false
+	}
+	moveTenantLoad(t, status)
+	t.TaskStatus = status
+	t.Transitions = append(t.Transitions, StatusTransition{status, time.Now()})
+	GlobalTasks[taskId] = t
+	return true
+}
+
+// pollTaskStatus asks the slaves for the status of every task which
+// is assigned but not yet finished.
+func (m *Master) pollTaskStatus() {
+	m.Logger.Info(logger.FormatLogMessage("msg", "Task status polling routine started"))
+	end := false
+	for !end {
+		select {
+		case <-m.close:
+			end = true
+		case <-time.After(constants.TaskStatusPollInterval):
+			m.pollTasks(time.Now())
+		}
+	}
+	m.closeWait.Done()
+}
+
+// pollTasks times out the tasks past their deadline and asks the slaves
+// for the status of the other running tasks.
+func (m *Master) pollTasks(now time.Time) {
+	var toPoll []MasterTask
+	var expired []int
+	GlobalTasksMtx.RLock()
+	for _, t := range GlobalTasks {
+		if isTerminalStatus(t.TaskStatus) {
+			continue
+		}
+		if !t.Deadline.IsZero() && now.After(t.Deadline) {
+			expired = append(expired, t.TaskId)
+		} else if t.AssignedTo != nil && statusRank(t.TaskStatus) > statusRank(packets.Unassigned) {
+			toPoll = append(toPoll, t)
+		}
+	}
+	GlobalTasksMtx.RUnlock()
+
+	// The slave stops by itself at the deadline, this covers tasks
+	// which are lost or waiting to be placed.
+	for _, id := range expired {
+		m.timeoutTask(id)
+	}
+
+	for i := range toPoll {
+		p := m.requestTaskStatusPacket(&toPoll[i])
+		pt := packets.CreatePacketTransmit(p, packets.TaskStatusRequest)
+		toPoll[i].AssignedTo.send(pt)
+	}
+}
+
+// removeFinishedTasks removes tasks from GlobalTasks which finished
+// before the retention period.
+func removeFinishedTasks() {
+	GlobalTasksMtx.Lock()
+	defer GlobalTasksMtx.Unlock()
+	for id, t := range GlobalTasks {
+		if !isTerminalStatus(t.TaskStatus) || len(t.Transitions) == 0 {
+			continue
+		}
+		if time.Since(t.Transitions[len(t.Transitions)-1].Time) > constants.FinishedTaskRetention {
+			delete(GlobalTasks, id)
+		}
+	}
+}
+
+// closeTask closes the Close channel of the task if not already closed.
+func closeTask(t *packets.TaskPacket) {
+	GlobalTasksMtx.Lock()
+	defer GlobalTasksMtx.Unlock()
+	select {
+	case <-t.Close:
+	default:
+		close(t.Close)
+	}
+}
+
+// finishTask moves the task to a terminal status with the reason and closes it.
+// It returns false if the task does not exist or has already finished.
+func finishTask(taskId int, status packets.Status, reason string) bool {
+	if !setTaskStatus(taskId, status) {
+		return false
+	}
+	GlobalTasksMtx.Lock()
+	t := GlobalTasks[taskId]
+	t.FailureReason = reason
+	GlobalTasks[taskId] = t
+	GlobalTasksMtx.Unlock()
+	closeTask(t.Task)
+	return true
+}
+
+// stopTask is like finishTask, but also asks the slave running the task to
+// stop, or takes the task out of the pending queue if it is waiting there.
+func (m *Master) stopTask(taskId int, status packets.Status, reason string) bool {
+	if !finishTask(taskId, status, reason) {
+		return false
+	}
+	GlobalTasksMtx.RLock()
+	t := GlobalTasks[taskId]
+	GlobalTasksMtx.RUnlock()
+
+	if t.AssignedTo != nil {
+		pt := packets.CreatePacketTransmit(packets.TaskCancelPacket{TaskId: taskId}, packets.TaskCancel)
+		t.AssignedTo.send(pt)
+	} else {
+		m.pending.remove(taskId, t.Class, t.Tenant)
+	}
+	return true
+}
+
+func (m *Master) cancelTask(taskId int) bool {
+	return m.stopTask(taskId, packets.Cancelled, "")
+}
+
+const deadlineExceeded = "Task deadline exceeded"
+
+func (m *Master) timeoutTask(taskId int) bool {
+	return m.stopTask(taskId, packets.TimedOut, deadlineExceeded)
+}
+
+func failTask(taskId int, reason string) bool {
+	return finishTask(taskId, packets.Failed, reason)
+}
+
+// requeueTask moves an unfinished task back to Unassigned for another attempt.
+// It returns a copy of the task and the number of attempts made before this one.
+func requeueTask(taskId int) (MasterTask, bool) {
+	return requeueTaskFrom(taskId, nil)
+}
+
+// requeueTaskFrom is like requeueTask, but only if the task is assigned to
+// the slave, or to any slave if it is nil. Requeueing the tasks of a slave
+// twice moves each task only once.
+func requeueTaskFrom(taskId int, from *Slave) (MasterTask, bool) {
+	GlobalTasksMtx.Lock()
+	defer GlobalTasksMtx.Unlock()
+	t, ok := GlobalTasks[taskId]
+	if !ok || isTerminalStatus(t.TaskStatus) || (from != nil && t.AssignedTo != from) {
+		return t, false
+	}
+	t.Attempts++
+	if t.AssignedTo != nil {
+		t.AssignedTo.removeInFlight(taskId)
+	}
+	t.AssignedTo = nil
+	t.IsAssigned = false
+	if t.TaskStatus != packets.Unassigned {
+		moveTenantLoad(t, packets.Unassigned)
+		t.TaskStatus = packets.Unassigned
+		t.Transitions = append(t.Transitions, StatusTransition{packets.Unassigned, time.Now()})
+	}
+	GlobalTasks[taskId] = t
+	return t, true
+}
+
+// tasksAssignedTo returns the ids of the unfinished tasks assigned to the slave.
+func tasksAssignedTo(s *Slave) []int {
+	GlobalTasksMtx.RLock()
+	defer GlobalTasksMtx.RUnlock()
+	var ids []int
+	for id, t := range GlobalTasks {
+		if t.AssignedTo == s && !isTerminalStatus(t.TaskStatus) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// isAssignedTo tells if the task is currently assigned to the slave.
+// Packets about the task from any other slave are stale.
+func isAssignedTo(taskId int, s *Slave) bool {
+	GlobalTasksMtx.RLock()
+	defer GlobalTasksMtx.RUnlock()
+	t, ok := GlobalTasks[taskId]
+	return ok && t.AssignedTo == s
+}
+
+// reassignTasks puts the unfinished tasks of a lost slave back in the
+// pending queue with the same task ids. Results still coming from the lost
+// slave are ignored since the tasks are no longer assigned to it.
+func (m *Master) reassignTasks(s *Slave) {
+	for _, id := range tasksAssignedTo(s) {
+		t, ok := requeueTaskFrom(id, s)
+		if !ok {
+			// Finished or moved meanwhile.
+			continue
+		}
+		if t.Attempts > m.MaxTaskRetries {
+			reason := "Task lost with its slave after " + strconv.Itoa(m.MaxTaskRetries) + " retries"
+			failTask(id, reason)
+			m.Logger.Warning(logger.FormatLogMessage("msg", "Giving up on task", "Task ID", strconv.Itoa(id), "reason", reason))
+			continue
+		}
+		if err := m.pending.push(&t); err != nil {
+			failTask(id, "Task lost with its slave: "+err.Error())
+			m.Logger.Warning(logger.FormatLogMessage("msg", "Failed to reassign task", "Task ID", strconv.Itoa(id), "err", err.Error()))
+			continue
+		}
+		m.Logger.Info(logger.FormatLogMessage("msg", "Reassigning task of lost slave", "Task ID", strconv.Itoa(id),
+			"slave_ip", s.ip, "slave_id", strconv.Itoa(int(s.id)), "attempt", strconv.Itoa(t.Attempts)))
+	}
+	m.signalDispatch()
+}
+
+// retryRoutine sends tasks rejected by a slave to another slave.
+func (m *Master) retryRoutine() {
+	end := false
+	for !end {
+		select {
+		case <-m.close:
+			end = true
+		case taskId := <-m.taskRejections:
+			go m.retryTask(taskId)
+		}
+	}
+	m.closeWait.Done()
+}
+
+// retryTask puts the task back in the pending queue after an exponential
+// backoff, till the retry budget is used up.
+func (m *Master) retryTask(taskId int) {
+	t, ok := requeueTask(taskId)
+	if !ok {
+		// Cancelled or deleted meanwhile.
+		return
+	}
+	if t.Attempts > m.MaxTaskRetries {
+		reason := "Task rejected by slaves after " + strconv.Itoa(m.MaxTaskRetries) + " retries"
+		failTask(taskId, reason)
+		m.Logger.Warning(logger.FormatLogMessage("msg", "Giving up on task", "Task ID", strconv.Itoa(taskId), "reason", reason))
+		return
+	}
+
+	backoff := constants.TaskRetryBackoffBaseTime << uint(t.Attempts-1)
+	if !t.Deadline.IsZero() && time.Now().Add(backoff).After(t.Deadline) {
+		// No point in retrying, it cannot finish in time.
+		m.timeoutTask(taskId)
+		return
+	}
+
+	select {
+	case <-m.close:
+		return
+	case <-t.Task.Close:
+		return
+	case <-time.After(backoff):
+	}
+
+	if err := m.pending.push(&t); err != nil {
+		failTask(taskId, "Task rejected by slave: "+err.Error())
+		m.Logger.Warning(logger.FormatLogMessage("msg", "Failed to retry task", "Task ID", strconv.Itoa(taskId), "err", err.Error()))
+		return
+	}
+	m.Logger.Info(logger.FormatLogMessage("msg", "Retrying task", "Task ID", strconv.Itoa(taskId), "attempt", strconv.Itoa(t.Attempts)))
+	m.signalDispatch()
+}
+
+// receives task status response and updates the status of the task
 func (s *Slave) handleTaskStatusResponse(packet packets.TaskStatusResponsePacket) {
-	s.Logger.Info(logger.FormatLogMessage("msg", "Task status", "task_id", strconv.Itoa(int(packet.TaskId)), "status", strconv.Itoa(int(packet.TaskStatus))))
+	s.Logger.Debug(logger.FormatLogMessage("msg", "Task status", "task_id", strconv.Itoa(int(packet.TaskId)), "status", packet.TaskStatus.String()))
+	if !isAssignedTo(packet.TaskId, s) {
+		return
+	}
+	switch packet.TaskStatus {
+	case packets.Accepted, packets.Running:
+		setTaskStatus(packet.TaskId, packet.TaskStatus)
+	case packets.Incomplete:
+		setTaskStatus(packet.TaskId, packets.Running)
+	default:
+		// Final status is taken only from the result.
+	}
 }
 
 func (s *Slave) handleTaskRequestResponse(packet packets.TaskRequestResponsePacket) {
+	if !isAssignedTo(packet.TaskId, s) {
+		s.removeInFlight(packet.TaskId)
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Ignoring reply for task no longer assigned to slave", "Task ID", strconv.Itoa(int(packet.TaskId))))
+		return
+	}
 	if !packet.Accept {
 		s.Logger.Warning(logger.FormatLogMessage("msg", "Slave did not accept task", "Task ID", strconv.Itoa(int(packet.TaskId))))
+		// The last load reported by the slave is wrong, so it is not chosen again till the next report.
+		s.removeInFlight(packet.TaskId)
+		s.markLoadStale()
+		select {
+		case s.rejectChan <- packet.TaskId:
+		case <-s.close:
+		}
 	} else {
 		s.Logger.Info(logger.FormatLogMessage("msg", "Slave accepted task", "Task ID", strconv.Itoa(int(packet.TaskId))))
+		setTaskStatus(packet.TaskId, packets.Accepted)
 	}
 }
 
 // recieves result of task from slave and displays it
 func (s *Slave) handleTaskResult(packet packets.TaskResultResponsePacket) {
+	s.removeInFlight(packet.TaskId)
+
+	GlobalTasksMtx.Lock()
+	orgTask, ok := GlobalTasks[packet.TaskId]
+	if !ok {
+		GlobalTasksMtx.Unlock()
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Result for unknown task", "Task ID", strconv.Itoa(int(packet.TaskId))))
+		return
+	}
+
+	if orgTask.AssignedTo != s {
+		// The task was given to another slave after this one was lost.
+		GlobalTasksMtx.Unlock()
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Ignoring late result from slave", "Task ID", strconv.Itoa(int(packet.TaskId)),
+			"status", packet.TaskStatus.String()))
+		return
+	}
+
+	if isTerminalStatus(orgTask.TaskStatus) {
+		// e.g. the task was cancelled or timed out on the master first.
+		GlobalTasksMtx.Unlock()
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Ignoring result for finished task", "Task ID", strconv.Itoa(int(packet.TaskId)),
+			"status", packet.TaskStatus.String()))
+		return
+	}
+
 	t := packet.Result
-	switch t.TaskTypeID {
-	case packets.FibonacciTaskType:
-		GlobalTasksMtx.RLock()
-		orgTask := GlobalTasks[packet.TaskId]
-		GlobalTasksMtx.RUnlock()
-		orgTask.Task.Result = t.Result
-		select {
-		case <-orgTask.Task.Close:
-		default:
-			close(orgTask.Task.Close)
-		}
-		s.Logger.Info(logger.FormatLogMessage("Task ID completed", strconv.Itoa(int(packet.TaskId)), "Result", strconv.Itoa(int(t.Result))))
-	case packets.CountPrimesTaskType:
-		GlobalTasksMtx.RLock()
-		orgTask := GlobalTasks[packet.TaskId]
-		GlobalTasksMtx.RUnlock()
-		orgTask.Task.Result = t.Result
-		select {
-		case <-orgTask.Task.Close:
-		default:
-			close(orgTask.Task.Close)
+	orgTask.Task.Result = t.Result
+	orgTask.Task.IntResult = t.IntResult
+	orgTask.Task.Output = t.Output
+	GlobalTasksMtx.Unlock()
+
+	switch packet.TaskStatus {
+	case packets.Complete:
+		s.recordOutcome(false, "task result")
+	case packets.Failed, packets.Invalid:
+		s.recordOutcome(true, "task result")
+	}
+
+	// Only successful runs tell how fast the slave is.
+	if packet.TaskStatus == packets.Complete {
+		if sent, ok := orgTask.dispatchTime(); ok {
+			s.observeLatency(orgTask.Task.TaskTypeID, time.Since(sent))
 		}
-		s.Logger.Info(logger.FormatLogMessage("Task ID completed", strconv.Itoa(int(packet.TaskId)), "Result", strconv.Itoa(int(t.IntResult))))
-	default:
-		s.Logger.Info(logger.FormatLogMessage("msg", "Unknown Task Type"))
 	}
 
+	switch packet.TaskStatus {
+	case packets.TimedOut:
+		finishTask(packet.TaskId, packets.TimedOut, deadlineExceeded)
+	case packets.Complete, packets.Cancelled:
+		finishTask(packet.TaskId, packet.TaskStatus, "")
+	default:
+		finishTask(packet.TaskId, packets.Failed, "Task failed on slave")
+	}
+	// The slave has capacity for pending tasks now.
+	s.notifyCapacity()
+	s.Logger.Info(logger.FormatLogMessage("Task ID completed", strconv.Itoa(int(packet.TaskId)), "Result", strconv.FormatUint(t.Result, 10)))
 }
 
 // takes task string and load and creates a task object
-func (m *Master) createTask(task *packets.TaskPacket, load uint64) *MasterTask {
-	taskId := m.lastTaskId + 1
-	t := MasterTask{TaskId: taskId,
-		Task:       task,
-		Load:       load,
-		AssignedTo: nil,
-		IsAssigned: false,
-		TaskStatus: packets.Unassigned}
+func (m *Master) createTask(task *packets.TaskPacket, opts taskOptions) *MasterTask {
+	if opts.Tenant == "" {
+		opts.Tenant = DefaultTenant
+	}
 	GlobalTasksMtx.Lock()
+	m.lastTaskId += 1
+	taskId := m.lastTaskId
+	t := MasterTask{TaskId: taskId,
+		Task:        task,
+		Load:        opts.Load,
+		Priority:    opts.Priority,
+		Deadline:    opts.Deadline,
+		Tenant:      opts.Tenant,
+		Class:       opts.Class,
+		AffinityKey: opts.AffinityKey,
+		Selector:    opts.Selector,
+		AssignedTo:  nil,
+		IsAssigned:  false,
+		TaskStatus:  packets.Unassigned,
+		Transitions: []StatusTransition{{packets.Unassigned, time.Now()}}}
 	GlobalTasks[taskId] = t
 	GlobalTasksMtx.Unlock()
-	m.lastTaskId += 1
 	return &t
 }
 
+// stores the assignment of the task in GlobalTasks, if the task was not deleted
+func updateTaskAssignment(t *MasterTask) {
+	GlobalTasksMtx.Lock()
+	defer GlobalTasksMtx.Unlock()
+	if gt, ok := GlobalTasks[t.TaskId]; ok {
+		gt.AssignedTo = t.AssignedTo
+		gt.IsAssigned = t.IsAssigned
+		GlobalTasks[t.TaskId] = gt
+	}
+}
+
+// claimTask assigns the task in GlobalTasks to the slave and moves it to
+// Assigned, if it is still waiting for a slave. It returns false if the task
+// was finished or taken by a slave meanwhile.
+func claimTask(t *MasterTask, s *Slave) bool {
+	GlobalTasksMtx.Lock()
+	defer GlobalTasksMtx.Unlock()
+	gt, ok := GlobalTasks[t.TaskId]
+	if !ok || gt.TaskStatus != packets.Unassigned || gt.AssignedTo != nil {
+		return false
+	}
+	moveTenantLoad(gt, packets.Assigned)
+	gt.AssignedTo = s
+	gt.IsAssigned = true
+	gt.TaskStatus = packets.Assigned
+	gt.Transitions = append(gt.Transitions, StatusTransition{packets.Assigned, time.Now()})
+	GlobalTasks[t.TaskId] = gt
+	*t = gt
+	return true
+}
+
 // takes a task, finds which slave to assign to, assigns it in task packet, and returns slave index
 func (m *Master) assignTask(t *MasterTask) (*Slave, error) {
-	slaveAssigned, err := m.loadBalancer.assignTask(t.Load)
+	slaveAssigned, err := m.chooseSlave(t)
 	if err != nil {
-		m.Logger.Error(logger.FormatLogMessage("err", "Assign Task Failed", "err", err.Error()))
+		m.Logger.Debug(logger.FormatLogMessage("err", "Assign Task Failed", "err", err.Error()))
 		return nil, errors.New("Assign Task Failed")
 	}
-	t.AssignedTo = slaveAssigned
-	t.IsAssigned = true
+	if !claimTask(t, slaveAssigned) {
+		return nil, ErrTaskNotPending
+	}
 	return slaveAssigned, nil
 }
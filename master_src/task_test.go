@@ -0,0 +1,164 @@
+package master
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+func TestReassignTasksKeepsTaskIds(t *testing.T) {
+	m := newTestMaster(t)
+	lostSlave := addTestSlave(m, 1, "a")
+	running := assignTestTask(m, lostSlave)
+	finished := assignTestTask(m, lostSlave)
+	finishTask(finished, packets.Complete, "")
+
+	lostSlave.stop()
+	m.reassignTasks(lostSlave)
+	// Reassigning twice, e.g. from gc and a resume, moves a task only once.
+	m.reassignTasks(lostSlave)
+
+	got := getTestTask(t, running)
+	if got.AssignedTo != nil || got.TaskStatus != packets.Unassigned || got.Attempts != 1 {
+		t.Fatalf("lost task = assigned to %v, %v, %d attempts; want unassigned with 1 attempt",
+			got.AssignedTo, got.TaskStatus, got.Attempts)
+	}
+	if n := m.pending.len(); n != 1 {
+		t.Fatalf("pending tasks = %d, want 1", n)
+	}
+	pt, ok := m.pending.peek(func(pendingTask) bool { return true })
+	if !ok || pt.taskId != running {
+		t.Fatalf("pending task = %d, want the original id %d", pt.taskId, running)
+	}
+
+	if got := getTestTask(t, finished); got.TaskStatus != packets.Complete || got.AssignedTo != lostSlave {
+		t.Fatalf("finished task = %v on %v, want it untouched", got.TaskStatus, got.AssignedTo)
+	}
+	GlobalTasksMtx.RLock()
+	n := len(GlobalTasks)
+	GlobalTasksMtx.RUnlock()
+	if n != 2 {
+		t.Fatalf("tasks = %d, want 2, no new task ids", n)
+	}
+}
+
+func TestLateResultFromLostSlaveIsIgnored(t *testing.T) {
+	m := newTestMaster(t)
+	lostSlave := addTestSlave(m, 1, "a")
+	newSlave := addTestSlave(m, 2, "b")
+	id := assignTestTask(m, lostSlave)
+
+	lostSlave.stop()
+	m.reassignTasks(lostSlave)
+	task := getTestTask(t, id)
+	task.AssignedTo = newSlave
+	task.IsAssigned = true
+	updateTaskAssignment(&task)
+	setTaskStatus(id, packets.Assigned)
+
+	lostSlave.handleTaskResult(packets.TaskResultResponsePacket{
+		TaskId:     id,
+		Result:     packets.TaskPacket{Result: 1},
+		TaskStatus: packets.Complete,
+	})
+	lostSlave.handleTaskStatusResponse(packets.TaskStatusResponsePacket{TaskId: id, TaskStatus: packets.Running})
+
+	got := getTestTask(t, id)
+	if got.TaskStatus != packets.Assigned || got.AssignedTo != newSlave || got.Task.Result != 0 {
+		t.Fatalf("task after a late result = %v on %v with result %d, want assigned to the new slave without result",
+			got.TaskStatus, got.AssignedTo, got.Task.Result)
+	}
+
+	newSlave.handleTaskResult(packets.TaskResultResponsePacket{
+		TaskId:     id,
+		Result:     packets.TaskPacket{Result: 55},
+		TaskStatus: packets.Complete,
+	})
+	got = getTestTask(t, id)
+	if got.TaskStatus != packets.Complete || got.Task.Result != 55 {
+		t.Fatalf("task after the result of the new slave = %v with result %d, want complete with 55",
+			got.TaskStatus, got.Task.Result)
+	}
+	waitClosed(t, got.Task.Close)
+}
+
+func TestRetryGoesThroughQueue(t *testing.T) {
+	m := newTestMaster(t)
+	s := addTestSlave(m, 1, "a")
+	id := assignTestTask(m, s)
+
+	m.retryTask(id)
+
+	got := getTestTask(t, id)
+	if got.AssignedTo != nil || got.TaskStatus != packets.Unassigned || got.Attempts != 1 {
+		t.Fatalf("rejected task = %v on %v, %d attempts; want unassigned with 1 attempt",
+			got.TaskStatus, got.AssignedTo, got.Attempts)
+	}
+	if n := m.pending.len(); n != 1 {
+		t.Fatalf("pending tasks = %d, want the rejected task queued", n)
+	}
+}
+
+func TestAssignTaskSkipsCancelledTask(t *testing.T) {
+	m := newTestMaster(t)
+	m.setLoadBalancer("least_load", &LeastLoad{})
+	s := addTestSlave(m, 1, "a")
+	id := queueTestTask(t, m, DefaultTenant, 10)
+	task := getTestTask(t, id)
+	m.cancelTask(id)
+
+	if _, err := m.assignTask(&task); err != ErrTaskNotPending {
+		t.Fatalf("assignTask of a cancelled task = %v, want %v", err, ErrTaskNotPending)
+	}
+	if got := getTestTask(t, id); got.AssignedTo != nil || got.TaskStatus != packets.Cancelled {
+		t.Fatalf("cancelled task = %v on %v, want cancelled and unassigned", got.TaskStatus, got.AssignedTo)
+	}
+	if n := s.inFlightCount(); n != 0 {
+		t.Fatalf("tasks in flight on slave = %d, want 0", n)
+	}
+}
+
+// setTestDeadline sets the deadline of the task in GlobalTasks.
+func setTestDeadline(id int, deadline time.Time) {
+	GlobalTasksMtx.Lock()
+	t := GlobalTasks[id]
+	t.Deadline = deadline
+	GlobalTasks[id] = t
+	GlobalTasksMtx.Unlock()
+}
+
+func TestPollTasksTimesOutExpiredTasks(t *testing.T) {
+	m := newTestMaster(t)
+	s, sent := addRecordingTestSlave(m, 1, "a", 4)
+	deadline := time.Now()
+	running := assignTestTask(m, s)
+	setTestDeadline(running, deadline)
+	queued := queueTestTask(t, m, DefaultTenant, 10)
+	setTestDeadline(queued, deadline)
+	// Polled, as its deadline has not passed.
+	later := assignTestTask(m, s)
+	setTestDeadline(later, deadline.Add(time.Hour))
+
+	m.pollTasks(deadline.Add(time.Millisecond))
+
+	for _, id := range []int{running, queued} {
+		got := getTestTask(t, id)
+		if got.TaskStatus != packets.TimedOut || got.FailureReason != deadlineExceeded {
+			t.Errorf("task %d after its deadline = %v %q, want TimedOut %q", id, got.TaskStatus, got.FailureReason, deadlineExceeded)
+		}
+	}
+	if got := getTestTask(t, later); got.TaskStatus != packets.Running {
+		t.Errorf("task before its deadline = %v, want Running", got.TaskStatus)
+	}
+	if n := m.pending.len(); n != 0 {
+		t.Errorf("pending tasks = %d, want the expired one removed", n)
+	}
+
+	if pt := <-sent; pt.PacketType != packets.TaskCancel || pt.Packet.(packets.TaskCancelPacket).TaskId != running {
+		t.Fatalf("first packet = %v %v, want the cancel of task %d", pt.PacketType, pt.Packet, running)
+	}
+	if pt := <-sent; pt.PacketType != packets.TaskStatusRequest || pt.Packet.(packets.TaskStatusRequestPacket).TaskId != later {
+		t.Fatalf("second packet = %v %v, want the status request of task %d", pt.PacketType, pt.Packet, later)
+	}
+}
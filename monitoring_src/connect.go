@@ -115,11 +115,6 @@ func (mo *Monitor) initListeners() error {
 	return nil
 }
 
-type tcpData struct {
-	n   int
-	buf [2048]byte
-}
-
 /// Request listener
 
 func (mo *Monitor) initReqListener() error {
@@ -148,6 +143,7 @@ func (mo *Monitor) reqListenManager(ln net.Listener) {
 	mo.closeWait.Add(1)
 	go mo.reqRecvAndUpdater(conn)
 
+	fw := packets.NewFrameWriter(conn, constants.MaxFrameSize)
 	end := false
 	for !end {
 		select {
@@ -155,12 +151,7 @@ func (mo *Monitor) reqListenManager(ln net.Listener) {
 			end = true
 		default:
 			packet := packets.MonitorRequestPacket{}
-			bytes, err := packets.EncodePacket(packet, packets.MonitorRequest)
-			if err != nil {
-				mo.Logger.Warning(logger.FormatLogMessage("msg", "Failed to encode packet"))
-			}
-
-			_, err = conn.Write(bytes)
+			err := fw.WritePacket(packet, packets.MonitorRequest)
 			if err != nil {
 				mo.Logger.Warning(logger.FormatLogMessage("msg", "Failed to send Req packet"))
 			}
@@ -173,28 +164,27 @@ func (mo *Monitor) reqListenManager(ln net.Listener) {
 
 func (mo *Monitor) reqRecvAndUpdater(conn net.Conn) {
 
+	fr := packets.NewFrameReader(conn, constants.MaxFrameSize)
 	end := false
 	for !end {
 		select {
 		case <-mo.close:
 			end = true
 		default:
-			// NOTE: make sure this size can fit the max slaves.
-			var buf [2048]byte
 			conn.SetReadDeadline(time.Now().Add(constants.MonitorReceiveTimeout))
-			n, err := conn.Read(buf[0:])
+			buf, err := fr.ReadFrame()
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 				continue
 			} else if err != nil {
 				mo.Logger.Error(logger.FormatLogMessage("msg", "Error in reading from TCP", "err", err.Error()))
-				if err == io.EOF {
+				if err == io.EOF || err == packets.ErrTruncatedFrame || err == packets.ErrFrameTooLarge {
 					close(mo.close)
 					end = true
 				}
 				continue
 			}
 
-			packetType, err := packets.GetPacketType(buf[:n])
+			packetType, err := packets.GetPacketType(buf)
 			if err != nil {
 				mo.Logger.Error(logger.FormatLogMessage("err", err.Error()))
 				return
@@ -203,7 +193,7 @@ func (mo *Monitor) reqRecvAndUpdater(conn net.Conn) {
 			switch packetType {
 			case packets.MonitorResponse:
 				var p packets.MonitorResponsePacket
-				err := packets.DecodePacket(buf[:n], &p)
+				err := packets.DecodePacket(buf, &p)
 				if err != nil {
 					mo.Logger.Error(logger.FormatLogMessage("msg", "Failed to decode packet",
 						"packet", packetType.String(), "err", err.Error()))
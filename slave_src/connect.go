@@ -5,61 +5,149 @@ import (
 	// "fmt"
 	"io"
 	"net"
-	"os"
 	"runtime"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoodDeeds/load-balancer/common/constants"
 	"github.com/GoodDeeds/load-balancer/common/logger"
 	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
 	"github.com/GoodDeeds/load-balancer/common/utility"
 	"github.com/cloudfoundry/gosigar"
 )
 
-func (s *Slave) connect() error {
+// session is one connection of the slave to the master.
+type session struct {
+	close     chan struct{}
+	closeOnce sync.Once
+	wait      sync.WaitGroup
+}
+
+func newSession() *session {
+	return &session{close: make(chan struct{})}
+}
 
-	err := s.initListeners()
-	utility.CheckFatal(err, s.Logger)
+// end closes the connection, the slave connects again.
+func (ss *session) end() {
+	ss.closeOnce.Do(func() { close(ss.close) })
+}
+
+// sessionRoutine keeps the slave connected to the master. When a connection
+// breaks, the slave discovers the master again with backoff and resumes with
+// the same ID and the tasks it still holds.
+func (s *Slave) sessionRoutine() {
+	backoff := constants.ConnectRetryBackoffBaseTime
+	end := false
+	for !end {
+		ss := newSession()
+		if err := s.connect(ss); err != nil {
+			s.Logger.Error(logger.FormatLogMessage("msg", "Failed to connect to master", "err", err.Error()))
+			ss.end()
+		} else {
+			backoff = constants.ConnectRetryBackoffBaseTime
+			if atomic.LoadInt32(&s.draining) == 1 {
+				// The master forgot the drain with the old connection.
+				go s.sendDrain(ss.close)
+			}
+			select {
+			case <-ss.close:
+				s.Logger.Warning(logger.FormatLogMessage("msg", "Lost connection to master"))
+			case <-s.close:
+				ss.end()
+			}
+		}
+		ss.wait.Wait()
 
+		select {
+		case <-s.close:
+			end = true
+		case <-time.After(backoff):
+			backoff *= 2
+			if backoff > constants.ReconnectBackoffMaxTime {
+				backoff = constants.ReconnectBackoffMaxTime
+			}
+			s.Logger.Info(logger.FormatLogMessage("msg", "Reconnecting to master"))
+		}
+	}
+	s.closeWait.Done()
+}
+
+// heldTasks returns the ids of the tasks on the slave.
+func (s *Slave) heldTasks() []int {
+	s.tasksMtx.RLock()
+	defer s.tasksMtx.RUnlock()
+	ids := make([]int, 0, len(s.tasks))
+	for id := range s.tasks {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+var errSlaveClosing = errors.New("Slave is closing")
+
+// connect discovers the master and sets up a session with it. Network errors
+// are returned, so that sessionRoutine tries again after a backoff.
+func (s *Slave) connect(ss *session) error {
 	udpAddr := &net.UDPAddr{
 		IP:   s.broadcastIP,
 		Port: int(constants.MasterBroadcastPort),
 	}
 	conn, err := net.DialUDP("udp", nil, udpAddr)
-	utility.CheckFatal(err, s.Logger)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
 	udpAddr = &net.UDPAddr{
 		IP:   s.myIP,
 		Port: 0,
 	}
 	connRecv, err := net.ListenUDP("udp", udpAddr)
-	utility.CheckFatal(err, s.Logger)
+	if err != nil {
+		return err
+	}
+	defer connRecv.Close()
 	myPort := utility.PortFromUDPConn(connRecv)
 
+	pkt := packets.BroadcastConnectRequest{
+		Source: s.myIP,
+		Port:   myPort,
+	}
+	encodedBytes, err := packets.EncodePacket(pkt, packets.ConnectionRequest)
+	if err != nil {
+		return err
+	}
+
 	tries := 0
 	var p packets.BroadcastConnectResponse
 	backoff := constants.ConnectRetryBackoffBaseTime
 	for !p.Ack && tries < constants.MaxConnectRetry {
-
-		pkt := packets.BroadcastConnectRequest{
-			Source: s.myIP,
-			Port:   myPort,
+		select {
+		case <-s.close:
+			return errSlaveClosing
+		case <-ss.close:
+			return errSlaveClosing
+		default:
 		}
-		encodedBytes, err := packets.EncodePacket(pkt, packets.ConnectionRequest)
-		utility.CheckFatal(err, s.Logger)
+		tries++
 
-		_, err = conn.Write(encodedBytes)
-		utility.CheckFatal(err, s.Logger)
+		if _, err := conn.Write(encodedBytes); err != nil {
+			return err
+		}
 
-		var buf [2048]byte
+		var buf [constants.MaxConnectPacketSize]byte
 		connRecv.SetReadDeadline(time.Now().Add(constants.ReceiveTimeout))
 		n, _, err := connRecv.ReadFromUDP(buf[:])
 		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			s.Logger.Debug(logger.FormatLogMessage("msg", "No response from master", "try", strconv.Itoa(tries)))
 			continue
 		} else if err != nil {
 			s.Logger.Error(logger.FormatLogMessage("err", err.Error()))
-			tries++
 			continue
 		}
 
@@ -67,20 +155,20 @@ func (s *Slave) connect() error {
 		if err != nil {
 			s.Logger.Error(logger.FormatLogMessage("err", err.Error()))
 			p.Ack = false
-			tries++
 			continue
 		}
 
-		tries++
-
 		if !p.Ack {
 			s.Logger.Warning(logger.FormatLogMessage("msg", "Got a NAC for connection request.", "try", strconv.Itoa(tries)))
 			if tries < constants.MaxConnectRetry {
-				time.Sleep(backoff)
+				select {
+				case <-s.close:
+					return errSlaveClosing
+				case <-time.After(backoff):
+				}
 				backoff = backoff * 2
 			}
 		}
-
 	}
 
 	if !p.Ack {
@@ -89,41 +177,53 @@ func (s *Slave) connect() error {
 
 	s.master.ip = p.IP
 
+	// The listeners are opened only now, so that the master has the whole
+	// accept timeout to connect to them.
+	if err := s.initListeners(ss); err != nil {
+		return err
+	}
+
 	ack := packets.BroadcastConnectResponse{
-		Ack:         true,
-		IP:          s.myIP,
-		Port:        myPort,
-		LoadReqPort: s.loadReqPort,
-		ReqSendPort: s.reqRecvPort,
-		ReqRecvPort: s.reqSendPort,
+		Ack:          true,
+		IP:           s.myIP,
+		Port:         myPort,
+		LoadReqPort:  s.loadReqPort,
+		ReqSendPort:  s.reqRecvPort,
+		ReqRecvPort:  s.reqSendPort,
+		Capabilities: tasks.Capabilities(s.TaskCapacity),
+		Labels:       s.Labels,
+		SlaveID:      s.ID,
 	}
 	ackBytes, err := packets.EncodePacket(ack, packets.ConnectionAck)
-	utility.CheckFatal(err, s.Logger)
+	if err != nil {
+		return err
+	}
+	if len(ackBytes) > constants.MaxConnectPacketSize {
+		return errors.New("Connection ack of " + strconv.Itoa(len(ackBytes)) + " bytes is too large, fewer labels or capabilities are needed")
+	}
 	for i := 0; i < constants.NumBurstAcks; i++ {
 		_, err = conn.Write(ackBytes)
 		if err != nil {
 			if i == 0 {
-				s.Logger.Critical(logger.FormatLogMessage("msg", "Failed to send Ack", "err", err.Error()))
-				os.Exit(1)
-			} else {
-				s.Logger.Warning(logger.FormatLogMessage("msg", "Failed to send some Acks", "err", err.Error()))
+				return errors.New("Failed to send Ack: " + err.Error())
 			}
+			s.Logger.Warning(logger.FormatLogMessage("msg", "Failed to send some Acks", "err", err.Error()))
 		}
 	}
 
-	s.Logger.Info(logger.FormatLogMessage("msg", "Connection response", "ack", strconv.FormatBool(p.Ack), "server_ip", p.IP.String()))
-	s.closeWait.Done()
+	s.Logger.Info(logger.FormatLogMessage("msg", "Connection response", "ack", strconv.FormatBool(p.Ack), "server_ip", p.IP.String(),
+		"slave_id", s.ID))
 	return nil
 }
 
 // Listeners.
 
-func (s *Slave) initListeners() error {
-	err := s.initLoadListener()
+func (s *Slave) initListeners(ss *session) error {
+	err := s.initLoadListener(ss)
 	if err != nil {
 		return err
 	}
-	err = s.initReqListener()
+	err = s.initReqListener(ss)
 	if err != nil {
 		return err
 	}
@@ -133,85 +233,133 @@ func (s *Slave) initListeners() error {
 
 type tcpData struct {
 	n   int
-	buf [2048]byte
+	buf []byte
+}
+
+// isStreamBroken tells if the error leaves the TCP stream unusable.
+func isStreamBroken(err error) bool {
+	return err == io.EOF || err == packets.ErrTruncatedFrame || err == packets.ErrFrameTooLarge
 }
 
-func (s *Slave) collectIncomingRequests(conn net.Conn, packetChan chan<- tcpData) {
+// isWriteBroken tells if a failed write leaves the TCP stream unusable.
+// A packet refused before anything is written, e.g. one over the max frame
+// size, leaves the stream as it was, unlike when reading.
+func isWriteBroken(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrShortWrite || err == io.ErrClosedPipe
+}
+
+// fallbackPacket returns the packet to send instead of one which cannot be
+// written, if any. A result which does not fit is sent as a failure, so the
+// master does not wait for the task.
+func fallbackPacket(pt packets.PacketTransmit) (packets.PacketTransmit, bool) {
+	p, ok := pt.Packet.(packets.TaskResultResponsePacket)
+	if !ok || pt.PacketType != packets.TaskResultResponse {
+		return pt, false
+	}
+	failed := packets.TaskResultResponsePacket{TaskId: p.TaskId, TaskStatus: packets.Failed}
+	return packets.CreatePacketTransmit(failed, packets.TaskResultResponse), true
+}
+
+func (s *Slave) collectIncomingRequests(conn net.Conn, packetChan chan<- tcpData, ss *session) {
+	fr := packets.NewFrameReader(conn, constants.MaxFrameSize)
 	end := false
 	for !end {
 		select {
-		case <-s.close:
+		case <-ss.close:
 			end = true
 		default:
-			var buf [2048]byte
 			conn.SetReadDeadline(time.Now().Add(constants.SlaveReceiveTimeout))
-			n, err := conn.Read(buf[0:])
+			buf, err := fr.ReadFrame()
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 				continue
 			} else if err != nil {
 				s.Logger.Error(logger.FormatLogMessage("msg", "Error in reading from TCP", "err", err.Error()))
-				if err == io.EOF {
-					select {
-					case <-s.close:
-					default:
-						close(s.close)
-					}
+				if isStreamBroken(err) {
+					ss.end()
 					end = true
 				}
 				continue
 			}
 
-			var bufCopy [2048]byte
-			copy(bufCopy[:], buf[:])
-			packetChan <- tcpData{
-				n:   n,
-				buf: bufCopy,
+			select {
+			case packetChan <- tcpData{
+				n:   len(buf),
+				buf: buf,
+			}:
+			case <-ss.close:
+				end = true
 			}
 		}
 	}
 
 }
 
+// acceptOrEnd accepts one connection on the listener and closes it. It gives
+// up after constants.SlaveConnectionAcceptTimeout or when the session ends.
+func acceptOrEnd(ln net.Listener, ss *session) (net.Conn, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ss.close:
+			ln.Close()
+		case <-done:
+		}
+	}()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(constants.SlaveConnectionAcceptTimeout))
+	conn, err := ln.Accept()
+	ln.Close()
+	return conn, err
+}
+
 /// Load listener
 
-func (s *Slave) initLoadListener() error {
+func (s *Slave) initLoadListener(ss *session) error {
 	ln, err := net.Listen("tcp", s.myIP.String()+":0")
 	if err != nil {
 		return err
 	}
 
-	s.closeWait.Add(1)
-	go s.loadListenManager(ln)
+	ss.wait.Add(1)
+	go s.loadListenManager(ln, ss)
 
 	port := ln.Addr().(*net.TCPAddr).Port
 	s.loadReqPort = uint16(port)
 	return nil
 }
 
-func (s *Slave) loadListenManager(ln net.Listener) {
+func (s *Slave) loadListenManager(ln net.Listener, ss *session) {
+	defer ss.wait.Done()
 
-	ln.(*net.TCPListener).SetDeadline(time.Now().Add(constants.SlaveConnectionAcceptTimeout))
-	conn, _ := ln.Accept()
+	conn, err := acceptOrEnd(ln, ss)
+	if err != nil {
+		s.Logger.Error(logger.FormatLogMessage("msg", "Master did not connect to Info Listener", "err", err.Error()))
+		ss.end()
+		return
+	}
+	defer conn.Close()
 
 	packetChan := make(chan tcpData)
-	go s.collectIncomingRequests(conn, packetChan)
+	go s.collectIncomingRequests(conn, packetChan, ss)
 
+	fw := packets.NewFrameWriter(conn, constants.MaxFrameSize)
 	end := false
 	for !end {
 		select {
-		case <-s.close:
+		case <-ss.close:
 			s.Logger.Info(logger.FormatLogMessage("msg", "Stopping Info Listener"))
 			end = true
 			break
 		default:
-			s.loadListener(conn, packetChan)
+			s.loadListener(fw, packetChan)
 		}
 	}
-
-	s.closeWait.Done()
 }
 
-func (s *Slave) loadListener(conn net.Conn, packetChan <-chan tcpData) {
+func (s *Slave) loadListener(fw *packets.FrameWriter, packetChan <-chan tcpData) {
 
 	select {
 	case packet, ok := <-packetChan:
@@ -252,14 +400,7 @@ func (s *Slave) loadListener(conn net.Conn, packetChan <-chan tcpData) {
 				MaxLoad:   s.maxLoad,
 			}
 
-			bytes, err := packets.EncodePacket(res, packets.LoadResponse)
-			if err != nil {
-				s.Logger.Error(logger.FormatLogMessage("msg", "Failed to encode packet",
-					"packet", packets.LoadResponse.String(), "err", err.Error()))
-				return
-			}
-
-			_, err = conn.Write(bytes)
+			err = fw.WritePacket(res, packets.LoadResponse)
 			if err != nil {
 				s.Logger.Error(logger.FormatLogMessage("msg", "Failed to send packet",
 					"packet", packets.LoadResponse.String(), "err", err.Error()))
@@ -279,7 +420,7 @@ func (s *Slave) loadListener(conn net.Conn, packetChan <-chan tcpData) {
 
 /// Request listener
 
-func (s *Slave) initReqListener() error {
+func (s *Slave) initReqListener(ss *session) error {
 	lnSend, err := net.Listen("tcp", s.myIP.String()+":0")
 	if err != nil {
 		return err
@@ -287,10 +428,11 @@ func (s *Slave) initReqListener() error {
 
 	lnRecv, err := net.Listen("tcp", s.myIP.String()+":0")
 	if err != nil {
+		lnSend.Close()
 		return err
 	}
-	s.closeWait.Add(1)
-	go s.reqListenManager(lnSend, lnRecv)
+	ss.wait.Add(1)
+	go s.reqListenManager(lnSend, lnRecv, ss)
 
 	port := lnSend.Addr().(*net.TCPAddr).Port
 	s.reqSendPort = uint16(port)
@@ -301,36 +443,48 @@ func (s *Slave) initReqListener() error {
 	return nil
 }
 
-func (s *Slave) reqListenManager(lnSend net.Listener, lnRecv net.Listener) {
+func (s *Slave) reqListenManager(lnSend net.Listener, lnRecv net.Listener, ss *session) {
+	defer ss.wait.Done()
 
 	var connSend, connRecv net.Conn
+	var errSend, errRecv error
 
 	wc := make(chan struct{})
 
 	go func() {
-		lnSend.(*net.TCPListener).SetDeadline(time.Now().Add(constants.SlaveConnectionAcceptTimeout))
-		connSend, _ = lnSend.Accept()
+		connSend, errSend = acceptOrEnd(lnSend, ss)
 		wc <- struct{}{}
 	}()
 
 	go func() {
-		lnRecv.(*net.TCPListener).SetDeadline(time.Now().Add(constants.SlaveConnectionAcceptTimeout))
-		connRecv, _ = lnRecv.Accept()
+		connRecv, errRecv = acceptOrEnd(lnRecv, ss)
 		wc <- struct{}{}
 	}()
 
 	<-wc
 	<-wc
 
+	if connSend != nil {
+		defer connSend.Close()
+	}
+	if connRecv != nil {
+		defer connRecv.Close()
+	}
+	if errSend != nil || errRecv != nil {
+		s.Logger.Error(logger.FormatLogMessage("msg", "Master did not connect to Request Listener"))
+		ss.end()
+		return
+	}
+
 	packetChan := make(chan tcpData)
-	go s.collectIncomingRequests(connRecv, packetChan)
-	s.closeWait.Add(1)
-	go s.sendChannelHandler(connSend)
+	go s.collectIncomingRequests(connRecv, packetChan, ss)
+	ss.wait.Add(1)
+	go s.sendChannelHandler(connSend, ss)
 
 	end := false
 	for !end {
 		select {
-		case <-s.close:
+		case <-ss.close:
 			s.Logger.Info(logger.FormatLogMessage("msg", "Stopping Request Listener"))
 			end = true
 			break
@@ -338,8 +492,6 @@ func (s *Slave) reqListenManager(lnSend net.Listener, lnRecv net.Listener) {
 			s.reqListener(packetChan)
 		}
 	}
-
-	s.closeWait.Done()
 }
 
 func (s *Slave) reqListener(packetChan <-chan tcpData) {
@@ -375,6 +527,19 @@ func (s *Slave) reqListener(packetChan <-chan tcpData) {
 				return
 			}
 			go s.respondTaskStatusPacket(p)
+		case packets.TaskCancel:
+			var p packets.TaskCancelPacket
+			err := packets.DecodePacket(packet.buf[:packet.n], &p)
+			if err != nil {
+				s.Logger.Error(logger.FormatLogMessage("msg", "Failed to decode packet",
+					"packet", packetType.String(), "err", err.Error()))
+				return
+			}
+			go s.cancelTask(p)
+		case packets.Drain:
+			// The master drained the slave and disconnects it.
+			s.Logger.Info(logger.FormatLogMessage("msg", "Slave drained by master"))
+			go s.Close()
 		default:
 			s.Logger.Warning(logger.FormatLogMessage("msg", "Received invalid packet"))
 		}
@@ -386,25 +551,49 @@ func (s *Slave) reqListener(packetChan <-chan tcpData) {
 
 }
 
-func (s *Slave) sendChannelHandler(conn net.Conn) {
-	defer s.closeWait.Done()
+// sendChannelHandler writes the packets from sendChan to the master. Packets
+// sent while the slave is not connected wait for the next connection.
+func (s *Slave) sendChannelHandler(conn net.Conn, ss *session) {
+	defer ss.wait.Done()
+	fw := packets.NewFrameWriter(conn, constants.MaxFrameSize)
+
+	// The master reconciles the tasks held by the slave before any result
+	// sent on this connection.
+	held := s.heldTasks()
+	if err := fw.WritePacket(packets.ResumePacket{Tasks: held}, packets.Resume); err != nil {
+		s.Logger.Error(logger.FormatLogMessage("msg", "Failed to send packet",
+			"packet", packets.Resume.String(), "err", err.Error()))
+		if isWriteBroken(err) {
+			ss.end()
+			return
+		}
+		// The master reassigns the held tasks when it drops the old session.
+	} else {
+		s.Logger.Info(logger.FormatLogMessage("msg", "Resumed session", "tasks_held", strconv.Itoa(len(held))))
+	}
+
 	end := false
 	for !end {
 		select {
-		case <-s.close:
+		case <-ss.close:
 			end = true
-		default:
-			pt := <-s.sendChan
-			bytes, err := packets.EncodePacket(pt.Packet, pt.PacketType)
-			if err != nil {
-				s.Logger.Error(logger.FormatLogMessage("msg", "Error in encoding packet", "err", err.Error()))
-				continue
+		case pt := <-s.sendChan:
+			err := fw.WritePacket(pt.Packet, pt.PacketType)
+			if err != nil && !isWriteBroken(err) {
+				s.Logger.Error(logger.FormatLogMessage("msg", "Dropped packet which cannot be sent",
+					"packet", pt.PacketType.String(), "err", err.Error()))
+				if failed, ok := fallbackPacket(pt); ok {
+					err = fw.WritePacket(failed.Packet, failed.PacketType)
+				}
 			}
-			_, err = conn.Write(bytes)
-			if err != nil {
+			if err != nil && isWriteBroken(err) {
 				s.Logger.Warning(logger.FormatLogMessage("msg", "Failed to send packet", "err", err.Error()))
+				// The connection is broken. A lost result is not a problem: the
+				// slave no longer holds the task when it connects again, so the
+				// master reassigns it.
+				ss.end()
+				end = true
 			}
-
 		}
 	}
 }
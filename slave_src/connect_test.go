@@ -0,0 +1,77 @@
+package slave
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/GoodDeeds/load-balancer/common/constants"
+	"github.com/GoodDeeds/load-balancer/common/logger"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+)
+
+func TestOversizedResultIsSentAsFailure(t *testing.T) {
+	s := &Slave{Logger: logger.NewLogger("test")}
+	s.initDS()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	ss := newSession()
+	ss.wait.Add(1)
+	go s.sendChannelHandler(local, ss)
+
+	fr := packets.NewFrameReader(remote, constants.MaxFrameSize)
+	readPacket := func() (packets.PacketType, []byte) {
+		buf, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := packets.GetPacketType(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pt, buf
+	}
+	if pt, _ := readPacket(); pt != packets.Resume {
+		t.Fatalf("first packet = %v, want %v", pt, packets.Resume)
+	}
+
+	huge := packets.TaskPacket{}
+	huge.SetOutput("result", strings.Repeat("x", int(constants.MaxFrameSize)))
+	s.sendChan <- packets.CreatePacketTransmit(packets.TaskResultResponsePacket{TaskId: 7, Result: huge, TaskStatus: packets.Complete}, packets.TaskResultResponse)
+
+	pt, buf := readPacket()
+	var p packets.TaskResultResponsePacket
+	if pt != packets.TaskResultResponse || packets.DecodePacket(buf, &p) != nil {
+		t.Fatalf("packet after the oversized result = %v, want %v", pt, packets.TaskResultResponse)
+	}
+	if p.TaskId != 7 || p.TaskStatus != packets.Failed {
+		t.Fatalf("result sent instead = task %d %v, want task 7 failed", p.TaskId, p.TaskStatus)
+	}
+	select {
+	case <-ss.close:
+		t.Fatal("session ended after a packet too large to send")
+	default:
+	}
+
+	ss.end()
+	ss.wait.Wait()
+}
+
+func TestConnectReturnsWhenClosing(t *testing.T) {
+	s := &Slave{Logger: logger.NewLogger("test")}
+	s.initDS()
+	s.myIP = net.IPv4(127, 0, 0, 1)
+	// Nobody answers on loopback.
+	s.broadcastIP = net.IPv4(127, 0, 0, 1)
+	close(s.close)
+
+	ss := newSession()
+	if err := s.connect(ss); err != errSlaveClosing {
+		t.Fatalf("connect of a closing slave = %v, want %v", err, errSlaveClosing)
+	}
+	if s.loadReqPort != 0 || s.reqSendPort != 0 {
+		t.Fatal("listeners were opened before the master answered")
+	}
+	ss.end()
+	ss.wait.Wait()
+}
@@ -1,11 +1,19 @@
 package slave
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"net"
-	// "os"
-	// "os/signal"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/GoodDeeds/load-balancer/common/constants"
 	"github.com/GoodDeeds/load-balancer/common/logger"
 	"github.com/GoodDeeds/load-balancer/common/packets"
 	"github.com/GoodDeeds/load-balancer/common/utility"
@@ -32,13 +40,28 @@ type Slave struct {
 	sendChan    chan packets.PacketTransmit
 
 	Logger *logging.Logger
+	// ID identifies the slave to the master across reconnections.
+	// A random ID is used if empty.
+	ID string
+	// Labels are advertised to the master, tasks can be placed by them.
+	Labels map[string]string
+	// TaskCapacity is the max number of tasks of a type to run at once,
+	// by task type name. No limit for types not present.
+	TaskCapacity map[string]int
+	// DrainTimeout is how long a draining slave waits for its tasks
+	// before it disconnects. constants.DrainTimeout is used if 0.
+	DrainTimeout time.Duration
+	// draining is 1 once the slave refuses new tasks.
+	draining int32
 
 	serverHandler *Handler
 	metric        Metric
 
 	close     chan struct{}
+	closeOnce sync.Once
 	closeWait sync.WaitGroup
-	tasks     map[int]SlaveTask
+	tasks     map[int]*SlaveTask
+	tasksMtx  sync.RWMutex
 }
 
 type Metric struct {
@@ -53,13 +76,25 @@ type SlaveTask struct {
 	Load       uint64
 	TaskStatus packets.Status
 	//	Result     packets.TaskPacket *packets.TaskResult
+
+	ctx         context.Context
+	cancel      context.CancelFunc
+	releaseOnce sync.Once
 }
 
 func (s *Slave) initDS() {
 	s.close = make(chan struct{})
 	s.maxLoad = 10000000
-	s.tasks = make(map[int]SlaveTask)
+	s.tasks = make(map[int]*SlaveTask)
 	s.sendChan = make(chan packets.PacketTransmit)
+	if s.ID == "" {
+		var b [8]byte
+		rand.Read(b[:])
+		s.ID = hex.EncodeToString(b[:])
+	}
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = constants.DrainTimeout
+	}
 }
 
 type TaskResult struct {
@@ -74,15 +109,107 @@ func (s *Slave) Run() {
 	s.StartServer(&HTTPOptions{
 		Logger: s.Logger,
 	})
-	s.closeWait.Add(1)
-	if err := s.connect(); err != nil {
-		s.Logger.Error(logger.FormatLogMessage("msg", "Failed to connect to master", "err", err.Error()))
-		s.Close()
-	}
+	s.closeWait.Add(2)
+	go s.sessionRoutine()
+	go s.heartbeatRoutine()
+	go s.signalHandler()
 	s.Logger.Info(logger.FormatLogMessage("msg", "Slave running"))
 	s.closeWait.Wait()
 }
 
+// heartbeatRoutine tells the master that the slave is alive.
+func (s *Slave) heartbeatRoutine() {
+	var seq uint64
+	end := false
+	for !end {
+		select {
+		case <-s.close:
+			end = true
+		case <-time.After(constants.HeartbeatInterval):
+			seq++
+			pt := packets.CreatePacketTransmit(packets.HeartbeatPacket{Seq: seq, Timestamp: time.Now()}, packets.Heartbeat)
+			select {
+			case s.sendChan <- pt:
+			case <-s.close:
+				end = true
+			}
+		}
+	}
+	s.closeWait.Done()
+}
+
+// signalHandler drains the slave on SIGINT or SIGTERM.
+// A second signal kills the slave right away.
+func (s *Slave) signalHandler() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-s.close:
+		signal.Stop(sig)
+	case <-sig:
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		s.Drain()
+	}
+}
+
+// Drain stops accepting tasks, asks the master to stop assigning tasks to
+// the slave, waits up to DrainTimeout for the running tasks and then
+// closes the slave. The master reassigns the tasks that did not finish.
+func (s *Slave) Drain() {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return
+	}
+	s.Logger.Info(logger.FormatLogMessage("msg", "Draining slave", "timeout", s.DrainTimeout.String()))
+	if !s.sendDrain(s.close) {
+		return
+	}
+
+	deadline := time.After(s.DrainTimeout)
+	end := false
+	for !end {
+		s.tasksMtx.RLock()
+		n := len(s.tasks)
+		s.tasksMtx.RUnlock()
+		if n == 0 {
+			s.Logger.Info(logger.FormatLogMessage("msg", "Slave drained"))
+			break
+		}
+		select {
+		case <-s.close:
+			// The master disconnected the slave.
+			end = true
+		case <-deadline:
+			s.Logger.Warning(logger.FormatLogMessage("msg", "Drain timed out", "tasks", strconv.Itoa(n)))
+			end = true
+		case <-time.After(constants.DrainCheckInterval):
+		}
+	}
+	s.Close()
+}
+
+// send queues the packet for the master. It returns false if the slave
+// closes first.
+func (s *Slave) send(pt packets.PacketTransmit) bool {
+	select {
+	case s.sendChan <- pt:
+		return true
+	case <-s.close:
+		return false
+	}
+}
+
+// sendDrain asks the master to drain the slave. It returns false if done
+// is closed first.
+func (s *Slave) sendDrain(done <-chan struct{}) bool {
+	pt := packets.CreatePacketTransmit(packets.DrainPacket{Timeout: s.DrainTimeout}, packets.Drain)
+	select {
+	case s.sendChan <- pt:
+		return true
+	case <-done:
+		return false
+	}
+}
+
 func (s *Slave) updateAddress() {
 	ipnet, err := utility.GetMyIP()
 	if err != nil {
@@ -95,13 +222,20 @@ func (s *Slave) updateAddress() {
 	}
 }
 
+// Close stops the slave, it is safe to call more than once.
 func (s *Slave) Close() {
-	s.Logger.Info(logger.FormatLogMessage("msg", "Closing Slave gracefully..."))
-
-	if err := s.serverHandler.Shutdown(); err != nil {
-		s.Logger.Error(logger.FormatLogMessage("msg", "Failed to ShutDown the server", "err", err.Error()))
-	}
-
-	close(s.close)
+	s.closeOnce.Do(func() {
+		s.Logger.Info(logger.FormatLogMessage("msg", "Closing Slave gracefully..."))
+
+		if err := s.serverHandler.Shutdown(); err != nil {
+			s.Logger.Error(logger.FormatLogMessage("msg", "Failed to ShutDown the server", "err", err.Error()))
+		}
+
+		select {
+		case <-s.close:
+		default:
+			close(s.close)
+		}
+	})
 	s.closeWait.Wait()
 }
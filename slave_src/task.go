@@ -1,57 +1,99 @@
 package slave
 
 import (
+	"context"
 	"strconv"
 	"sync/atomic"
 
 	// "github.com/GoodDeeds/load-balancer/common/constants"
 	"github.com/GoodDeeds/load-balancer/common/logger"
 	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
 )
 
 func (s *Slave) getTask(p packets.TaskRequestPacket) {
 	response := packets.TaskRequestResponsePacket{TaskId: p.TaskId}
 	atomic.AddUint32(&s.metric.TasksRequested, 1)
-	if s.currentLoad+p.Load > s.maxLoad {
+	def, err := tasks.Lookup(p.Task.TaskTypeID)
+	// Checking the capacity and taking it happen under one lock, so that
+	// two tasks at once cannot both take the last of it.
+	s.tasksMtx.Lock()
+	if atomic.LoadInt32(&s.draining) == 1 {
+		response.Accept = false
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Slave refused task while draining", "Task ID", strconv.Itoa(int(p.TaskId))))
+	} else if err != nil || def.Execute == nil {
+		response.Accept = false
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Slave refused task of unsupported type", "Task ID", strconv.Itoa(int(p.TaskId)),
+			"Task Type", strconv.Itoa(int(p.Task.TaskTypeID))))
+	} else if capacity := s.TaskCapacity[def.Name]; capacity > 0 && s.runningOfTypeLocked(def.ID) >= capacity {
+		response.Accept = false
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Slave refused task due to task type capacity", "Task ID", strconv.Itoa(int(p.TaskId)),
+			"Task Type", def.Name))
+	} else if load := def.Load(&p.Task); atomic.LoadUint64(&s.currentLoad)+load > s.maxLoad {
 		response.Accept = false
 		s.Logger.Warning(logger.FormatLogMessage("msg", "Slave refused task due to load limit", "Task ID", strconv.Itoa(int(p.TaskId))))
 	} else {
-		t := SlaveTask{TaskId: p.TaskId, Task: p.Task, Load: p.Load, TaskStatus: packets.Incomplete}
-		go s.handleTask(&t)
+		t := &SlaveTask{TaskId: p.TaskId, Task: p.Task, Load: load, TaskStatus: packets.Accepted}
+		if p.Deadline.IsZero() {
+			t.ctx, t.cancel = context.WithCancel(context.Background())
+		} else {
+			t.ctx, t.cancel = context.WithDeadline(context.Background(), p.Deadline)
+		}
+		s.tasks[t.TaskId] = t
+		atomic.AddUint64(&s.currentLoad, load)
+		go s.handleTask(t)
 		response.Accept = true
-		atomic.AddUint64(&s.currentLoad, packets.LoadFunctions[p.Task.TaskTypeID](p.Task.N))
 		atomic.AddUint32(&s.metric.TasksAccepted, 1)
 		s.Logger.Info(logger.FormatLogMessage("msg", "Slave accepted task", "Task ID", strconv.Itoa(int(p.TaskId))))
 	}
-	pt := packets.CreatePacketTransmit(response, packets.TaskRequestResponse)
-	s.sendChan <- pt
+	s.tasksMtx.Unlock()
+	s.send(packets.CreatePacketTransmit(response, packets.TaskRequestResponse))
+}
+
+// runningOfTypeLocked returns the number of tasks of the type on the slave.
+// tasksMtx must be held.
+func (s *Slave) runningOfTypeLocked(taskType packets.TaskType) int {
+	n := 0
+	for _, t := range s.tasks {
+		if t.Task.TaskTypeID == taskType {
+			n++
+		}
+	}
+	return n
 }
 
 func (s *Slave) respondTaskStatusPacket(p packets.TaskStatusRequestPacket) {
 	status := s.getStatus(p.TaskId)
-	response := packets.TaskStatusResponsePacket{p.TaskId, status}
-	pt := packets.CreatePacketTransmit(response, packets.TaskStatusResponse)
-	s.sendChan <- pt
+	response := packets.TaskStatusResponsePacket{TaskId: p.TaskId, TaskStatus: status}
+	s.send(packets.CreatePacketTransmit(response, packets.TaskStatusResponse))
 }
 
 func (s *Slave) sendTaskResult(t *SlaveTask) {
 	response := packets.TaskResultResponsePacket{TaskId: t.TaskId}
-	if t.TaskStatus != packets.Complete {
-		s.Logger.Warning(logger.FormatLogMessage("msg", "Task is not yet complete", "Task ID", strconv.Itoa(int(t.TaskId))))
-		response.TaskStatus = packets.Incomplete
+	if status := s.getStatus(t.TaskId); status != packets.Complete {
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Task is not complete", "Task ID", strconv.Itoa(int(t.TaskId))))
+		response.TaskStatus = status
 	} else {
 		response.Result = t.Task
 		response.TaskStatus = packets.Complete
 		s.Logger.Info(logger.FormatLogMessage("msg", "Task is complete", "Task ID", strconv.Itoa(int(t.TaskId))))
 		s.displayResult(&t.Task, t.TaskId)
 	}
-	atomic.AddUint64(&s.currentLoad, ^(packets.LoadFunctions[t.Task.TaskTypeID](t.Task.N) - 1))
+	s.releaseLoad(t)
 	atomic.AddUint32(&s.metric.TasksCompleted, 1)
-	pt := packets.CreatePacketTransmit(response, packets.TaskResultResponse)
-	s.sendChan <- pt
+	if !s.send(packets.CreatePacketTransmit(response, packets.TaskResultResponse)) {
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Slave closed before sending result", "Task ID", strconv.Itoa(int(t.TaskId))))
+	}
+
+	// The master knows the final status from the result.
+	s.tasksMtx.Lock()
+	delete(s.tasks, t.TaskId)
+	s.tasksMtx.Unlock()
 }
 
 func (s *Slave) getStatus(taskId int) (status packets.Status) {
+	s.tasksMtx.RLock()
+	defer s.tasksMtx.RUnlock()
 	task, ok := s.tasks[taskId]
 	if !ok {
 		return packets.Invalid
@@ -59,22 +101,65 @@ func (s *Slave) getStatus(taskId int) (status packets.Status) {
 	return task.TaskStatus
 }
 
+func (s *Slave) setStatus(taskId int, status packets.Status) {
+	s.tasksMtx.Lock()
+	defer s.tasksMtx.Unlock()
+	if task, ok := s.tasks[taskId]; ok {
+		task.TaskStatus = status
+	}
+}
+
+// releaseLoad removes the load of the task from the slave's load, only once.
+func (s *Slave) releaseLoad(t *SlaveTask) {
+	t.releaseOnce.Do(func() {
+		atomic.AddUint64(&s.currentLoad, ^(t.Load - 1))
+	})
+}
+
+// cancelTask stops the task and releases its load right away.
+// The result with Cancelled status is sent once the executor returns.
+func (s *Slave) cancelTask(p packets.TaskCancelPacket) {
+	s.tasksMtx.Lock()
+	t, ok := s.tasks[p.TaskId]
+	if ok {
+		t.TaskStatus = packets.Cancelled
+	}
+	s.tasksMtx.Unlock()
+	if !ok {
+		s.Logger.Warning(logger.FormatLogMessage("msg", "Cancel for unknown task", "Task ID", strconv.Itoa(p.TaskId)))
+		return
+	}
+
+	t.cancel()
+	s.releaseLoad(t)
+	s.Logger.Info(logger.FormatLogMessage("msg", "Task cancelled", "Task ID", strconv.Itoa(p.TaskId)))
+}
+
 func (s *Slave) handleTask(t *SlaveTask) {
+	defer t.cancel()
 	s.Logger.Info(logger.FormatLogMessage("msg", "Handling Task", "Task ID", strconv.Itoa(int(t.TaskId))))
-	s.runTask(&t.Task)
-	//	time.Sleep(2 * time.Second)
-	t.TaskStatus = packets.Complete
+	s.setStatus(t.TaskId, packets.Running)
+	if err := tasks.Execute(t.ctx, &t.Task); err != nil {
+		if t.ctx.Err() == context.DeadlineExceeded {
+			s.Logger.Warning(logger.FormatLogMessage("msg", "Task timed out", "Task ID", strconv.Itoa(int(t.TaskId))))
+			s.setStatus(t.TaskId, packets.TimedOut)
+		} else if t.ctx.Err() != nil {
+			s.setStatus(t.TaskId, packets.Cancelled)
+		} else {
+			s.Logger.Error(logger.FormatLogMessage("msg", "Task failed", "Task ID", strconv.Itoa(int(t.TaskId)), "err", err.Error()))
+			s.setStatus(t.TaskId, packets.Failed)
+		}
+	} else {
+		s.setStatus(t.TaskId, packets.Complete)
+	}
 	s.Logger.Info(logger.FormatLogMessage("msg", "Done Task", "Task ID", strconv.Itoa(int(t.TaskId))))
 	s.sendTaskResult(t)
 }
 
 func (s *Slave) displayResult(t *packets.TaskPacket, taskId int) {
-	switch t.TaskTypeID {
-	case packets.FibonacciTaskType:
-		s.Logger.Info(logger.FormatLogMessage("Task ID", strconv.Itoa(taskId), "Result", strconv.Itoa(int(t.Result)), "Description", t.Description()))
-	case packets.CountPrimesTaskType:
-		s.Logger.Info(logger.FormatLogMessage("Task ID", strconv.Itoa(taskId), "Result", strconv.Itoa(int(t.IntResult)), "Description", t.Description()))
-	default:
-		s.Logger.Warning("msg", "Unknown Task Type")
+	msg := []string{"Task ID", strconv.Itoa(taskId), "Description", tasks.Describe(t.TaskTypeID)}
+	for name, val := range t.Output {
+		msg = append(msg, name, val)
 	}
+	s.Logger.Info(logger.FormatLogMessage(msg...))
 }
@@ -0,0 +1,130 @@
+package slave
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/GoodDeeds/load-balancer/common/logger"
+	"github.com/GoodDeeds/load-balancer/common/packets"
+	"github.com/GoodDeeds/load-balancer/common/tasks"
+)
+
+func TestGetTaskReservesCapacityOnce(t *testing.T) {
+	s := &Slave{Logger: logger.NewLogger("test"), TaskCapacity: map[string]int{"count_primes": 1}}
+	s.initDS()
+	s.maxLoad = 1 << 62
+	const n = 20
+	s.sendChan = make(chan packets.PacketTransmit, 2*n)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			// Runs till cancelled.
+			task := packets.TaskPacket{TaskTypeID: tasks.CountPrimesTaskType, N: 1 << 20}
+			s.getTask(packets.TaskRequestPacket{TaskId: id, Task: task})
+		}(i)
+	}
+	wg.Wait()
+
+	accepted := 0
+	for i := 0; i < n; i++ {
+		pt := <-s.sendChan
+		if p, ok := pt.Packet.(packets.TaskRequestResponsePacket); ok && p.Accept {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("accepted tasks = %d, want 1 with a capacity of 1", accepted)
+	}
+
+	s.tasksMtx.RLock()
+	for _, task := range s.tasks {
+		task.cancel()
+	}
+	s.tasksMtx.RUnlock()
+}
+
+func TestCancelStopsRunningTask(t *testing.T) {
+	s := &Slave{Logger: logger.NewLogger("test")}
+	s.initDS()
+	s.maxLoad = 1 << 62
+	s.sendChan = make(chan packets.PacketTransmit, 2)
+
+	// Runs till cancelled.
+	task := packets.TaskPacket{TaskTypeID: tasks.CountPrimesTaskType, N: 1 << 30}
+	s.getTask(packets.TaskRequestPacket{TaskId: 1, Task: task})
+	if p, ok := (<-s.sendChan).Packet.(packets.TaskRequestResponsePacket); !ok || !p.Accept {
+		t.Fatalf("task was not accepted")
+	}
+
+	s.cancelTask(packets.TaskCancelPacket{TaskId: 1})
+	select {
+	case pt := <-s.sendChan:
+		p, ok := pt.Packet.(packets.TaskResultResponsePacket)
+		if !ok {
+			t.Fatalf("got packet %T, want TaskResultResponsePacket", pt.Packet)
+		}
+		if p.TaskStatus != packets.Cancelled {
+			t.Errorf("result status = %v, want Cancelled", p.TaskStatus)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slave did not stop the cancelled task")
+	}
+	if load := atomic.LoadUint64(&s.currentLoad); load != 0 {
+		t.Errorf("load after cancel = %d, want 0", load)
+	}
+	if status := s.getStatus(1); status != packets.Invalid {
+		t.Errorf("task still known with status %v", status)
+	}
+}
+
+func TestSendReturnsWhenClosing(t *testing.T) {
+	s := &Slave{Logger: logger.NewLogger("test")}
+	s.initDS()
+	close(s.close)
+
+	done := make(chan struct{})
+	go func() {
+		s.respondTaskStatusPacket(packets.TaskStatusRequestPacket{TaskId: 1})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("response blocked on a closed slave")
+	}
+}
+
+func TestTaskStopsAtDeadline(t *testing.T) {
+	s := &Slave{Logger: logger.NewLogger("test")}
+	s.initDS()
+	s.maxLoad = 1 << 62
+	s.sendChan = make(chan packets.PacketTransmit, 2)
+
+	// Runs till the deadline.
+	task := packets.TaskPacket{TaskTypeID: tasks.CountPrimesTaskType, N: 1 << 30}
+	s.getTask(packets.TaskRequestPacket{TaskId: 1, Task: task, Deadline: time.Now().Add(50 * time.Millisecond)})
+	if p, ok := (<-s.sendChan).Packet.(packets.TaskRequestResponsePacket); !ok || !p.Accept {
+		t.Fatalf("task was not accepted")
+	}
+
+	select {
+	case pt := <-s.sendChan:
+		p, ok := pt.Packet.(packets.TaskResultResponsePacket)
+		if !ok {
+			t.Fatalf("got packet %T, want TaskResultResponsePacket", pt.Packet)
+		}
+		if p.TaskStatus != packets.TimedOut {
+			t.Errorf("result status = %v, want TimedOut", p.TaskStatus)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slave did not stop the task at its deadline")
+	}
+	if load := atomic.LoadUint64(&s.currentLoad); load != 0 {
+		t.Errorf("load after the deadline = %d, want 0", load)
+	}
+}